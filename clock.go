@@ -0,0 +1,109 @@
+package hsm
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the time source for time events.  The default clock uses the
+// time package; tests can use a FakeClock to advance time deterministically.
+type Clock interface {
+	Now() time.Time
+	// AfterFunc calls f, on its own goroutine, once the duration elapses.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer started by a Clock.
+type Timer interface {
+	// Stop prevents the timer from firing, returning false if it has
+	// already fired or been stopped.
+	Stop() bool
+}
+
+// realClock is the Clock based on the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// FakeClock is a Clock whose time only moves when advanced, calling the
+// functions of the timers that are due on the goroutine advancing it.
+type FakeClock struct {
+	now    time.Time
+	timers []*fakeTimer
+	sync.Mutex
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	when  time.Time
+	f     func()
+}
+
+// NewFakeClock creates a fake clock set to the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake clock's current time.
+func (clock *FakeClock) Now() time.Time {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.now
+}
+
+// AfterFunc starts a timer calling f once the clock is advanced by d.
+func (clock *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	clock.Lock()
+	defer clock.Unlock()
+	timer := &fakeTimer{clock: clock, when: clock.now.Add(d), f: f}
+	clock.timers = append(clock.timers, timer)
+	return timer
+}
+
+// Advance moves the clock forward by d, firing the due timers in order,
+// including those started by the timers fired.  The clock's time is set to
+// each timer's time as it fires.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.Lock()
+	end := clock.now.Add(d)
+	clock.Unlock()
+
+	for {
+		clock.Lock()
+		sort.SliceStable(clock.timers, func(i, j int) bool {
+			return clock.timers[i].when.Before(clock.timers[j].when)
+		})
+		if len(clock.timers) == 0 || clock.timers[0].when.After(end) {
+			clock.now = end
+			clock.Unlock()
+			return
+		}
+		timer := clock.timers[0]
+		clock.timers = clock.timers[1:]
+		clock.now = timer.when
+		clock.Unlock()
+
+		timer.f()
+	}
+}
+
+// Stop removes the timer from the fake clock.
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.Lock()
+	defer clock.Unlock()
+	for i, t := range clock.timers {
+		if t == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,288 @@
+package hsm
+
+import (
+	"sort"
+)
+
+// ActiveStates returns the active leaf states in document order.  There is
+// one active leaf for each active orthogonal region, or a single leaf, equal
+// to CurrentState, when no orthogonal regions are active.
+func (hsm *Base) ActiveStates() []State {
+	names := make([]State, 0, len(hsm.leaves))
+	for _, leaf := range hsm.leaves {
+		names = append(names, leaf.Name)
+	}
+	return names
+}
+
+// isActive returns true if the state is part of the active configuration.
+func (hsm *Base) isActive(state *StateInstance) bool {
+	for _, leaf := range hsm.leaves {
+		if state.contains(leaf) {
+			return true
+		}
+	}
+	return false
+}
+
+// activeStates returns every active state, leaves and their ancestors, in
+// document order.
+func (hsm *Base) activeStates() []*StateInstance {
+	active := []*StateInstance{}
+	for _, leaf := range hsm.leaves {
+		for state := leaf; state != nil; state = state.parent {
+			if !containsState(active, state) {
+				active = append(active, state)
+			}
+		}
+	}
+	sortDocumentOrder(active)
+	return active
+}
+
+// exitSet returns the active states below the transition domain, innermost
+// states first and orthogonal regions in reverse document order.
+func (hsm *Base) exitSet(domain *StateInstance) []*StateInstance {
+	exitSet := []*StateInstance{}
+	for _, leaf := range hsm.leaves {
+		if domain != nil && !domain.contains(leaf) {
+			continue
+		}
+		for state := leaf; state != domain; state = state.parent {
+			if !containsState(exitSet, state) {
+				exitSet = append(exitSet, state)
+			}
+		}
+	}
+	sortDocumentOrder(exitSet)
+	for i, j := 0, len(exitSet)-1; i < j; i, j = i+1, j-1 {
+		exitSet[i], exitSet[j] = exitSet[j], exitSet[i]
+	}
+	return exitSet
+}
+
+// entrySet returns the states entered by a transition to the target: the
+// states from below the domain down to the target, then the default states
+// of every entered composite and every region of entered orthogonal states.
+// States are returned outermost first, in document order.
+func (hsm *Base) entrySet(domain *StateInstance, target *StateInstance,
+	exitSet []*StateInstance) []*StateInstance {
+
+	entrySet := []*StateInstance{}
+	pending := []*StateInstance{}
+	for _, resolved := range hsm.resolveHistory(target) {
+		if resolved == domain {
+			// The domain's descendants were exited; only its default
+			// states are entered.
+			pending = append(pending, resolved)
+		}
+		for state := resolved; state != domain; state = state.parent {
+			if !containsState(entrySet, state) {
+				entrySet = append(entrySet, state)
+				pending = append(pending, state)
+			}
+		}
+	}
+
+	// The machine is turned off by entering the top state alone.
+	if hsm.runState != EXITING {
+		for len(pending) > 0 {
+			state := pending[0]
+			pending = pending[1:]
+			for _, child := range hsm.defaultChildren(state, entrySet, exitSet) {
+				entrySet = append(entrySet, child)
+				pending = append(pending, child)
+			}
+		}
+	}
+	sortDocumentOrder(entrySet)
+	return entrySet
+}
+
+// defaultChildren returns the children of an entered state that must be
+// entered by default: every region of an orthogonal state, or the default
+// state of a composite state, unless already active or being entered.
+func (hsm *Base) defaultChildren(state *StateInstance,
+	entrySet []*StateInstance, exitSet []*StateInstance) []*StateInstance {
+
+	remainsActive := func(child *StateInstance) bool {
+		return containsState(entrySet, child) ||
+			(hsm.isActive(child) && !containsState(exitSet, child))
+	}
+
+	children := []*StateInstance{}
+	if state.parallel {
+		for _, child := range state.children {
+			if child.kind == regularState && !remainsActive(child) {
+				children = append(children, child)
+			}
+		}
+		return children
+	}
+	if state.initialState == "" {
+		return children
+	}
+	for _, child := range state.children {
+		if remainsActive(child) {
+			return children
+		}
+	}
+	initial, err := hsm.lookupState(state.initialState)
+	if err != nil {
+		return children
+	}
+	return append(children, initial)
+}
+
+// setConfiguration updates the active leaf states and CurrentState after the
+// exit set has been exited and the entry set entered.
+func (hsm *Base) setConfiguration(exitSet []*StateInstance,
+	entrySet []*StateInstance) {
+
+	active := []*StateInstance{}
+	for _, state := range hsm.activeStates() {
+		if !containsState(exitSet, state) {
+			active = append(active, state)
+		}
+	}
+	active = append(active, entrySet...)
+
+	leaves := []*StateInstance{}
+	for _, state := range active {
+		isLeaf := true
+		for _, other := range active {
+			if other.parent == state {
+				isLeaf = false
+				break
+			}
+		}
+		if isLeaf {
+			leaves = append(leaves, state)
+		}
+	}
+	sortDocumentOrder(leaves)
+	hsm.leaves = leaves
+
+	// The current state is the innermost state containing every active leaf.
+	if len(leaves) == 0 {
+		return
+	}
+	current := leaves[0]
+	for _, leaf := range leaves[1:] {
+		for !current.contains(leaf) {
+			current = current.parent
+		}
+	}
+	hsm.CurrentState = current.Name
+}
+
+// queueCompletions queues a completion event for each composite state whose
+// final state was entered, and for each orthogonal state whose regions have
+// all completed as a result.
+func (hsm *Base) queueCompletions(entrySet []*StateInstance) {
+	for _, state := range entrySet {
+		if state.kind != finalState || state.parent == nil {
+			continue
+		}
+		composite := state.parent
+		hsm.completions = append(hsm.completions, composite)
+		if hsm.owner != nil && composite.parent == hsm.topState {
+			hsm.completed = true
+		}
+		orthogonal := composite.parent
+		if orthogonal != nil && orthogonal.parallel &&
+			!containsState(hsm.completions, orthogonal) &&
+			hsm.regionsComplete(orthogonal) {
+			hsm.completions = append(hsm.completions, orthogonal)
+		}
+	}
+}
+
+// regionsComplete returns true if every region of the orthogonal state has
+// an active final state.
+func (hsm *Base) regionsComplete(orthogonal *StateInstance) bool {
+	for _, region := range orthogonal.children {
+		if region.kind != regularState {
+			continue
+		}
+		complete := false
+		for _, leaf := range hsm.leaves {
+			if leaf.kind == finalState && leaf.parent == region {
+				complete = true
+				break
+			}
+		}
+		if !complete {
+			return false
+		}
+	}
+	return true
+}
+
+// recordHistory saves the active leaf states below each exited composite
+// state, so history pseudostates can later restore them.
+func (hsm *Base) recordHistory(exitSet []*StateInstance) {
+	for _, state := range exitSet {
+		if len(state.children) == 0 {
+			continue
+		}
+		leaves := []State{}
+		for _, leaf := range hsm.leaves {
+			if state.contains(leaf) {
+				leaves = append(leaves, leaf.Name)
+			}
+		}
+		// A state exited before, by an interrupted transition, keeps the
+		// history recorded then.
+		if len(leaves) > 0 {
+			hsm.history[state.Name] = leaves
+		}
+	}
+}
+
+// resolveHistory replaces a history pseudostate target with the states it
+// restores: the last active child of the composite for shallow history or
+// the last active leaves for deep history.  The composite itself, and so its
+// default states, is the target if it has no recorded history.
+func (hsm *Base) resolveHistory(target *StateInstance) []*StateInstance {
+	if target.kind != shallowHistoryState && target.kind != deepHistoryState {
+		return []*StateInstance{target}
+	}
+	composite := target.parent
+	leafNames, ok := hsm.history[composite.Name]
+	if !ok || len(leafNames) == 0 {
+		return []*StateInstance{composite}
+	}
+
+	resolved := []*StateInstance{}
+	for _, name := range leafNames {
+		leaf, err := hsm.lookupState(name)
+		if err != nil {
+			return []*StateInstance{composite}
+		}
+		if target.kind == shallowHistoryState {
+			for leaf.parent != composite {
+				leaf = leaf.parent
+			}
+		}
+		if !containsState(resolved, leaf) {
+			resolved = append(resolved, leaf)
+		}
+	}
+	return resolved
+}
+
+func containsState(states []*StateInstance, state *StateInstance) bool {
+	for _, s := range states {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+func sortDocumentOrder(states []*StateInstance) {
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].order < states[j].order
+	})
+}
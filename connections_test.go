@@ -0,0 +1,132 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evResume      hsm.Event = "resume"
+	evAbort       hsm.Event = "abort"
+	stLaundry     hsm.State = "laundry"
+	stWasherOff   hsm.State = "washerOff"
+	stWasher      hsm.State = "washer"
+	stFill        hsm.State = "fill"
+	stRinse       hsm.State = "rinse"
+	stDrained     hsm.State = "drained"
+	stResumePoint hsm.State = "resumePoint"
+	stAbortPoint  hsm.State = "abortPoint"
+)
+
+// newConnectionsHSM builds a laundry whose washer is resumed at rinse
+// through an entry point and aborted through an exit point.
+func newConnectionsHSM(tr *trace) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("connectionsHSM")
+
+	laundry := sm.NewState(stLaundry)
+	washerOff := sm.NewState(stWasherOff)
+	washerOff.AddTransitions([]hsm.Transition{
+		{On: evResume, NewState: stResumePoint,
+			Action: tr.action(string(evResume))}})
+	washer := sm.NewState(stWasher)
+	washer.AddEntryActions(tr.entry(string(stWasher)))
+	washer.AddExitActions(tr.exit(string(stWasher)))
+	fill := sm.NewState(stFill)
+	fill.AddEntryActions(tr.entry(string(stFill)))
+	rinse := sm.NewState(stRinse)
+	rinse.AddEntryActions(tr.entry(string(stRinse)))
+	rinse.AddExitActions(tr.exit(string(stRinse)))
+	rinse.AddTransitions([]hsm.Transition{
+		{On: evAbort, NewState: stAbortPoint}})
+	resumePoint := sm.NewEntryPoint(stResumePoint)
+	resumePoint.AddTransitions([]hsm.Transition{
+		{NewState: stRinse, Action: tr.action(string(stResumePoint))}})
+	abortPoint := sm.NewExitPoint(stAbortPoint)
+	abortPoint.AddTransitions([]hsm.Transition{
+		{NewState: stDrained}})
+	drained := sm.NewState(stDrained)
+	drained.AddEntryActions(tr.entry(string(stDrained)))
+
+	washer.AddChildren(fill, rinse, resumePoint, abortPoint)
+	laundry.AddChildren(washerOff, washer, drained)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestEntryExitPoints(t *testing.T) {
+
+	Convey("CASE: Entry and Exit Points", t, func() {
+		tr := &trace{}
+		sm := newConnectionsHSM(tr)
+		sm.On()
+		*tr = nil
+
+		Convey("1. An entry point routes into a sub-state of its composite\n", func() {
+			preview, err := sm.Preview(evResume, nil)
+			So(err, ShouldBeNil)
+			phases := []hsm.ActionPhase{}
+			for _, step := range preview.Steps {
+				phases = append(phases, step.Phase)
+			}
+			So(phases, ShouldResemble, []hsm.ActionPhase{hsm.ExitPhase,
+				hsm.TransitionPhase, hsm.EntryPhase, hsm.TransitionPhase,
+				hsm.EntryPhase})
+			So(preview.Steps[3].State, ShouldEqual, stResumePoint)
+			So(sm.Inject(evResume, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stRinse)
+			So(*tr, ShouldResemble, trace{"resume action",
+				"washer entry", "resumePoint action", "rinse entry"})
+		})
+
+		Convey("2. An exit point leaves its composite\n", func() {
+			sm.Inject(evResume, nil)
+			*tr = nil
+			So(sm.Inject(evAbort, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stDrained)
+			So(*tr, ShouldResemble, trace{"rinse exit", "washer exit",
+				"drained entry"})
+		})
+
+		Convey("3. Entry and exit points are drawn as connection points\n", func() {
+			uml, err := sm.ExportPlantUML(hsm.DiagramOptions{})
+			So(err, ShouldBeNil)
+			So(uml, ShouldContainSubstring, "state resumePoint <<entryPoint>>")
+			So(uml, ShouldContainSubstring, "state abortPoint <<exitPoint>>")
+		})
+	})
+
+	Convey("CASE: Entry and Exit Point Validation", t, func() {
+		sm := &hsm.Base{}
+		sm.Configure("invalidConnectionsHSM")
+		laundry := sm.NewState(stLaundry)
+		washer := sm.NewState(stWasher)
+		washer.AddChildren(sm.NewState(stFill))
+		drained := sm.NewState(stDrained)
+		laundry.AddChildren(washer, drained)
+
+		Convey("1. Entry point branches must stay inside the composite\n", func() {
+			resumePoint := sm.NewEntryPoint(stResumePoint)
+			resumePoint.AddTransitions([]hsm.Transition{
+				{NewState: stDrained}})
+			washer.AddChildren(resumePoint)
+			So(sm.Validate().Errors(), ShouldHaveLength, 1)
+		})
+
+		Convey("2. Exit point branches must leave the composite\n", func() {
+			abortPoint := sm.NewExitPoint(stAbortPoint)
+			abortPoint.AddTransitions([]hsm.Transition{
+				{NewState: stFill}})
+			washer.AddChildren(abortPoint)
+			So(sm.Validate().Errors(), ShouldHaveLength, 1)
+		})
+
+		Convey("3. Entry and exit points need a branch\n", func() {
+			laundry.AddChildren(sm.NewExitPoint(stAbortPoint))
+			So(sm.Validate().Errors(), ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,85 @@
+package hsm
+
+import (
+	"context"
+)
+
+// ContextActionFunc is a context-aware callback for transition, entry and
+// exit actions.  It receives the context given to InjectContext, or
+// context.Background() for events injected otherwise, carrying the running
+// Instance, see InstanceFromContext.
+type ContextActionFunc func(ctx context.Context, param interface{}) error
+
+// ContextGuardFunc is a context-aware callback that returns true if
+// transition is allowed.
+type ContextGuardFunc func(ctx context.Context, param interface{}) (bool, error)
+
+// AddContextEntryActions defines one or more context-aware entry actions
+// for a given state, run after its other entry actions.
+func (state *StateInstance) AddContextEntryActions(
+	actions ...ContextActionFunc) {
+	if state.configurable() {
+		state.contextEntryActions = append(state.contextEntryActions,
+			actions...)
+	}
+}
+
+// AddContextExitActions defines one or more context-aware exit actions for
+// a given state, run after its other exit actions.
+func (state *StateInstance) AddContextExitActions(
+	actions ...ContextActionFunc) {
+	if state.configurable() {
+		state.contextExitActions = append(state.contextExitActions,
+			actions...)
+	}
+}
+
+// entryActionList returns the entry actions of the state, in the order they
+// run.
+func (state *StateInstance) entryActionList() []interface{} {
+	return actionList(state.entryActions, state.contextEntryActions)
+}
+
+// exitActionList returns the exit actions of the state, in the order they
+// run.
+func (state *StateInstance) exitActionList() []interface{} {
+	return actionList(state.exitActions, state.contextExitActions)
+}
+
+func actionList(actions []ActionFunc,
+	contextActions []ContextActionFunc) []interface{} {
+
+	list := make([]interface{}, 0, len(actions)+len(contextActions))
+	for _, action := range actions {
+		list = append(list, action)
+	}
+	for _, action := range contextActions {
+		list = append(list, action)
+	}
+	return list
+}
+
+// actions returns the actions of the transition, in the order they run.
+func (tran *Transition) actions() []interface{} {
+	list := []interface{}{}
+	if tran.Action != nil {
+		list = append(list, tran.Action)
+	}
+	if tran.ContextAction != nil {
+		list = append(list, tran.ContextAction)
+	}
+	return list
+}
+
+// guards returns the guards of the transition, in the order they are
+// evaluated.
+func (tran *Transition) guards() []interface{} {
+	list := []interface{}{}
+	if tran.Guard != nil {
+		list = append(list, tran.Guard)
+	}
+	if tran.ContextGuard != nil {
+		list = append(list, tran.ContextGuard)
+	}
+	return list
+}
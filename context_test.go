@@ -0,0 +1,90 @@
+package hsm_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evFetch    hsm.Event = "fetch"
+	stClient   hsm.State = "client"
+	stStandby  hsm.State = "standby"
+	stFetching hsm.State = "fetching"
+)
+
+type traceKey struct{}
+
+// newContextHSM builds a client whose fetch transition records the trace
+// ID of its context, and whose fetching state may cancel the context on
+// entry.
+func newContextHSM(tr *trace, cancel *context.CancelFunc) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("contextHSM")
+
+	client := sm.NewState(stClient)
+	standby := sm.NewState(stStandby)
+	standby.AddTransitions([]hsm.Transition{
+		{On: evFetch, NewState: stFetching,
+			ContextGuard: func(ctx context.Context, param interface{}) (bool, error) {
+				return ctx.Value(traceKey{}) != nil, nil
+			},
+			ContextAction: func(ctx context.Context, param interface{}) error {
+				*tr = append(*tr, "trace "+ctx.Value(traceKey{}).(string))
+				return nil
+			}},
+	})
+	fetching := sm.NewState(stFetching)
+	fetching.AddContextEntryActions(
+		func(ctx context.Context, param interface{}) error {
+			if *cancel != nil {
+				(*cancel)()
+			}
+			return nil
+		},
+		func(ctx context.Context, param interface{}) error {
+			*tr = append(*tr, "fetching entry")
+			return nil
+		})
+
+	client.AddChildren(standby, fetching)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestContextInjection(t *testing.T) {
+
+	Convey("CASE: Context-Aware Actions and Guards", t, func() {
+		tr := &trace{}
+		var cancel context.CancelFunc
+		sm := newContextHSM(tr, &cancel)
+		sm.On()
+		ctx := context.WithValue(context.Background(), traceKey{}, "t1")
+
+		Convey("1. Context actions and guards receive the event context\n", func() {
+			So(sm.Inject(evFetch, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stStandby)
+			So(sm.InjectContext(ctx, evFetch, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stFetching)
+			So(*tr, ShouldResemble, trace{"trace t1", "fetching entry"})
+		})
+
+		Convey("2. A done context aborts the remaining actions\n", func() {
+			ctx, cancel = context.WithCancel(ctx)
+			err := sm.InjectContext(ctx, evFetch, nil)
+			So(errors.Is(err, context.Canceled), ShouldBeTrue)
+			So(*tr, ShouldResemble, trace{"trace t1"})
+		})
+
+		Convey("3. No event is dispatched for a context already done\n", func() {
+			ctx, cancel := context.WithCancel(ctx)
+			cancel()
+			So(sm.InjectContext(ctx, evFetch, nil), ShouldEqual, context.Canceled)
+			So(*tr, ShouldBeEmpty)
+		})
+	})
+}
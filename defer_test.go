@@ -0,0 +1,95 @@
+package hsm_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evSend       hsm.Event = "send"
+	evConnected  hsm.Event = "connected"
+	stLink       hsm.State = "link"
+	stConnecting hsm.State = "connecting"
+	stLinkUp     hsm.State = "linkUp"
+	stSending    hsm.State = "sending"
+)
+
+// newDeferHSM builds a link whose connecting state defers the send event
+// until the link is up.  The trace ID of the context of the send event, if
+// any, is sent after its param.
+func newDeferHSM(sent *[]interface{}) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("deferHSM")
+
+	link := sm.NewState(stLink)
+	connecting := sm.NewState(stConnecting)
+	connecting.AddDeferredEvents(evSend)
+	connecting.AddTransitions([]hsm.Transition{
+		{On: evConnected, NewState: stLinkUp}})
+	linkUp := sm.NewState(stLinkUp)
+	linkUp.AddTransitions([]hsm.Transition{
+		{On: evSend, NewState: stSending,
+			Action: func(param interface{}) error {
+				*sent = append(*sent, param)
+				return nil
+			},
+			ContextAction: func(ctx context.Context, param interface{}) error {
+				if id, ok := ctx.Value(traceKey{}).(string); ok {
+					*sent = append(*sent, id)
+				}
+				return nil
+			}},
+	})
+	sending := sm.NewState(stSending)
+
+	link.AddChildren(connecting, linkUp, sending)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestDeferredEvents(t *testing.T) {
+
+	Convey("CASE: Deferred Events", t, func() {
+		sent := []interface{}{}
+		sm := newDeferHSM(&sent)
+		sm.On()
+
+		Convey("1. A deferred event is kept while its state is active\n", func() {
+			So(sm.Inject(evSend, "hello"), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stConnecting)
+			So(sent, ShouldBeEmpty)
+		})
+
+		Convey("2. A deferred event is dispatched once no state defers it\n", func() {
+			sm.Inject(evSend, "hello")
+			So(sm.Inject(evConnected, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stSending)
+			So(sent, ShouldResemble, []interface{}{"hello"})
+		})
+
+		Convey("3. Events that are not deferred remain unhandled\n", func() {
+			So(sm.Inject(hsm.Event("other"), nil), ShouldNotBeNil)
+		})
+
+		Convey("4. A deferred event is dispatched with its own context\n", func() {
+			ctx := context.WithValue(context.Background(), traceKey{}, "t1")
+			So(sm.InjectContext(ctx, evSend, "hello"), ShouldBeNil)
+			ctx = context.WithValue(context.Background(), traceKey{}, "t2")
+			So(sm.InjectContext(ctx, evConnected, nil), ShouldBeNil)
+			So(sent, ShouldResemble, []interface{}{"hello", "t1"})
+		})
+
+		Convey("5. A deferred event whose context is done is discarded\n", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			So(sm.InjectContext(ctx, evSend, "hello"), ShouldBeNil)
+			cancel()
+			So(sm.Inject(evConnected, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stLinkUp)
+			So(sent, ShouldBeEmpty)
+		})
+	})
+}
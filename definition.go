@@ -0,0 +1,102 @@
+package hsm
+
+import (
+	"context"
+	"fmt"
+)
+
+// Definition is a compiled, immutable state machine definition: the states,
+// their hierarchy, transitions and actions of a finalized machine.  A
+// definition is built once and shared by any number of instances, each
+// holding only its own active configuration, history, queued events and
+// timers.  Actions and guards are shared too, so they must keep any
+// per-instance data outside their closures, for example in the event param
+// or the instance Context.  Context-aware actions and guards reach the
+// running instance with InstanceFromContext; closures over the machine the
+// definition was compiled from would act on that machine instead.
+type Definition struct {
+	name          string
+	states        map[State]*StateInstance
+	topState      *StateInstance
+	failurePolicy FailurePolicy
+	errorState    State
+	base          *Base
+}
+
+// Instance is a running state machine sharing a Definition.
+type Instance struct {
+	Base
+	// Context holds per-instance data, such as the session served by the
+	// instance.
+	Context interface{}
+}
+
+// Definition compiles the finalized state machine into a Definition.  The
+// states of the machine are shared with the definition, so the machine and
+// its states can no longer be configured once compiled: their Add methods
+// have no effect.  An error is returned if the
+// machine is not finalized.
+func (hsm *Base) Definition() (*Definition, error) {
+	if hsm.definition != nil {
+		return hsm.definition, nil
+	}
+	if hsm.runState != FINALIZED {
+		err := fmt.Errorf("cannot compile hsm %s; it is not finalized",
+			hsm.Name)
+		hsm.log.Error(err)
+		return nil, err
+	}
+	for _, state := range hsm.states {
+		state.frozen = true
+	}
+	hsm.definition = &Definition{
+		name:          hsm.Name,
+		states:        hsm.states,
+		topState:      hsm.topState,
+		failurePolicy: hsm.failurePolicy,
+		errorState:    hsm.errorState,
+		base:          hsm,
+	}
+	return hsm.definition, nil
+}
+
+// Name returns the name of the machine the definition was compiled from.
+func (def *Definition) Name() string {
+	return def.name
+}
+
+// NewInstance creates a finalized instance of the definition, ready to be
+// turned on, using the logger, clock and failure policy of the machine the
+// definition was compiled from.
+func (def *Definition) NewInstance(name string, context interface{}) *Instance {
+	sm := &Instance{Context: context}
+	sm.instance = sm
+	sm.Name = name
+	sm.CurrentState = def.topState.Name
+	sm.states = def.states
+	sm.topState = def.topState
+	sm.definition = def
+	sm.runState = FINALIZED
+	sm.history = make(map[State][]State)
+	sm.leaves = []*StateInstance{def.topState}
+	sm.queueSignal = make(chan struct{}, 1)
+	sm.clock = def.base.clock
+	sm.timers = make(map[*StateInstance][]*armedTimer)
+	sm.failurePolicy = def.failurePolicy
+	sm.errorState = def.errorState
+	sm.logger = def.base.logger
+	sm.addLoggerEntry()
+	return sm
+}
+
+// instanceKey is the context key of the running instance.
+type instanceKey struct{}
+
+// InstanceFromContext returns the instance running the context-aware action
+// or guard given the context, or nil if the machine running it is not an
+// Instance.  Actions shared by a Definition use it to reach the instance
+// Context or to Post follow-up events to the instance.
+func InstanceFromContext(ctx context.Context) *Instance {
+	sm, _ := ctx.Value(instanceKey{}).(*Instance)
+	return sm
+}
@@ -0,0 +1,112 @@
+package hsm_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evLogin     hsm.Event = "login"
+	evLogout    hsm.Event = "logout"
+	stSession   hsm.State = "session"
+	stAnonymous hsm.State = "anonymous"
+	stSignedIn  hsm.State = "signedIn"
+	stHistory   hsm.State = "sessionHistory"
+)
+
+// newSessionDefinition compiles a session that signs in on the login event
+// and resumes its last state through a shallow history pseudostate.
+func newSessionDefinition(tr *trace) *hsm.Definition {
+	sm := &hsm.Base{}
+	sm.Configure("sessionHSM")
+
+	session := sm.NewState(stSession)
+	anonymous := sm.NewState(stAnonymous)
+	anonymous.AddTransitions([]hsm.Transition{
+		{On: evLogin, NewState: stSignedIn}})
+	signedIn := sm.NewState(stSignedIn)
+	signedIn.AddEntryActions(tr.entry(string(stSignedIn)))
+	signedIn.AddTransitions([]hsm.Transition{
+		{On: evLogout, NewState: stAnonymous}})
+	history := sm.NewShallowHistory(stHistory)
+
+	session.AddChildren(anonymous, signedIn, history)
+
+	sm.Finalize()
+	def, _ := sm.Definition()
+	return def
+}
+
+func TestDefinition(t *testing.T) {
+
+	Convey("CASE: Shared Definitions", t, func() {
+		tr := &trace{}
+		def := newSessionDefinition(tr)
+
+		Convey("1. Instances of a definition run independently\n", func() {
+			first := def.NewInstance("first", 1)
+			second := def.NewInstance("second", 2)
+			So(first.On(), ShouldBeNil)
+			So(second.On(), ShouldBeNil)
+			So(first.Inject(evLogin, nil), ShouldBeNil)
+			So(first.CurrentState, ShouldEqual, stSignedIn)
+			So(second.CurrentState, ShouldEqual, stAnonymous)
+			So(second.Context, ShouldEqual, 2)
+			So(*tr, ShouldResemble, trace{"signedIn entry"})
+		})
+
+		Convey("2. Compiled machines cannot be configured\n", func() {
+			sm := def.NewInstance("third", nil)
+			sm.Configure("third")
+			So(sm.NewState("extra"), ShouldBeNil)
+			So(sm.Finalize(), ShouldNotBeNil)
+			So(sm.On(), ShouldBeNil)
+		})
+
+		Convey("3. Only finalized machines can be compiled\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("draft")
+			sm.NewState("draftTop")
+			def, err := sm.Definition()
+			So(def, ShouldBeNil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("4. Shared actions reach the running instance from the context\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("greeterHSM")
+			top := sm.NewState("greeterTop")
+			greeting := sm.NewState("greeting")
+			greeting.AddContextEntryActions(
+				func(ctx context.Context, param interface{}) error {
+					sm := hsm.InstanceFromContext(ctx)
+					*tr = append(*tr, fmt.Sprintf("%s %v", sm.Name, sm.Context))
+					return nil
+				})
+			top.AddChildren(greeting)
+			sm.Finalize()
+			def, _ := sm.Definition()
+			So(def.NewInstance("first", 1).On(), ShouldBeNil)
+			So(def.NewInstance("second", 2).On(), ShouldBeNil)
+			So(*tr, ShouldResemble, trace{"first 1", "second 2"})
+			So(hsm.InstanceFromContext(context.Background()), ShouldBeNil)
+		})
+
+		Convey("5. The states of a compiled machine cannot be configured\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("frozenHSM")
+			top := sm.NewState("frozenTop")
+			leaf := sm.NewState("frozenLeaf")
+			top.AddChildren(leaf)
+			sm.Finalize()
+			def, _ := sm.Definition()
+			leaf.AddEntryActions(tr.entry("frozenLeaf"))
+			So(def.NewInstance("first", nil).On(), ShouldBeNil)
+			So(*tr, ShouldBeEmpty)
+		})
+	})
+}
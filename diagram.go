@@ -0,0 +1,427 @@
+package hsm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiagramOptions control diagram export.
+type DiagramOptions struct {
+	// Registry, if set, names guards and actions as they are registered;
+	// otherwise their function names are used.
+	Registry *Registry
+	// HighlightCurrent highlights the active leaf states.
+	HighlightCurrent bool
+}
+
+// diagramEdge is a transition drawn between two states.
+type diagramEdge struct {
+	source *StateInstance
+	target *StateInstance
+	label  string
+}
+
+// diagram holds the states and transitions of a machine being exported.
+type diagram struct {
+	hsm      *Base
+	options  DiagramOptions
+	top      *StateInstance
+	edges    map[*StateInstance][]diagramEdge
+	internal map[*StateInstance][]string
+	ids      map[*StateInstance]string
+	out      strings.Builder
+}
+
+// newDiagram collects the transitions of the machine.  Each transition is
+// drawn in the innermost composite state strictly containing its source
+// and target; internal transitions are listed inside their state.
+func (hsm *Base) newDiagram(options DiagramOptions) (*diagram, error) {
+	top := hsm.userTopState()
+	if top == nil {
+		return nil, fmt.Errorf("cannot export hsm %s; it has no top state",
+			hsm.Name)
+	}
+	d := &diagram{
+		hsm:      hsm,
+		options:  options,
+		top:      top,
+		edges:    make(map[*StateInstance][]diagramEdge),
+		internal: make(map[*StateInstance][]string),
+		ids:      make(map[*StateInstance]string),
+	}
+	used := map[string]bool{}
+	d.walk(top, func(state *StateInstance) {
+		d.ids[state] = diagramID(state.Name, used)
+		for _, event := range sortedEvents(state) {
+			if event == hsmExitEvent {
+				continue
+			}
+			for _, tran := range state.transitions[event] {
+				label := d.label(tran)
+				if tran.NewState == "" {
+					d.internal[state] = append(d.internal[state], label)
+					continue
+				}
+				target, ok := hsm.states[tran.NewState]
+				if !ok {
+					continue
+				}
+				owner := state.parent
+				for owner != nil &&
+					(owner == target || !owner.contains(target)) {
+					owner = owner.parent
+				}
+				if owner == hsm.topState {
+					owner = nil
+				}
+				d.edges[owner] = append(d.edges[owner],
+					diagramEdge{state, target, label})
+			}
+		}
+	})
+	return d, nil
+}
+
+// diagramID returns an identifier for the state name, unique among those
+// used, made of ASCII letters, digits and underscores for PlantUML and
+// Mermaid.  Other characters are replaced with underscores.
+func diagramID(name State, used map[string]bool) string {
+	id := []rune(string(name))
+	for i, r := range id {
+		if r != '_' && !isDigit(r) && !(r >= 'a' && r <= 'z') &&
+			!(r >= 'A' && r <= 'Z') {
+			id[i] = '_'
+		}
+	}
+	base := string(id)
+	if base == "" || isDigit(id[0]) {
+		base = "_" + base
+	}
+	unique := base
+	for n := 2; used[unique]; n++ {
+		unique = fmt.Sprintf("%s_%d", base, n)
+	}
+	used[unique] = true
+	return unique
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+// declaration returns how PlantUML and Mermaid declare the state: its
+// identifier alone when it is its name, or its name as a quoted label
+// with double quotes drawn as single quotes.
+func (d *diagram) declaration(state *StateInstance) string {
+	id := d.ids[state]
+	if id == string(state.Name) {
+		return id
+	}
+	label := strings.Replace(string(state.Name), "\"", "'", -1)
+	return fmt.Sprintf("\"%s\" as %s", label, id)
+}
+
+// walk calls fn for the state and its descendants in document order.
+func (d *diagram) walk(state *StateInstance, fn func(*StateInstance)) {
+	fn(state)
+	for _, child := range state.children {
+		d.walk(child, fn)
+	}
+}
+
+// label returns "event [guard] / action" for a transition.
+func (d *diagram) label(tran *Transition) string {
+	parts := []string{}
+	if tran.On != "" {
+		parts = append(parts, string(tran.On))
+	}
+	if tran.Else {
+		parts = append(parts, "[else]")
+	} else if guards := tran.guards(); len(guards) > 0 {
+		parts = append(parts, "["+d.names(guards, " && ")+"]")
+	}
+	if actions := tran.actions(); len(actions) > 0 {
+		parts = append(parts, "/ "+d.names(actions, ", "))
+	}
+	return strings.Join(parts, " ")
+}
+
+// name returns the registered name of a guard or action, or its function
+// name without the package path.
+func (d *diagram) name(fn interface{}) string {
+	name := d.options.Registry.nameOf(fn)
+	if d.options.Registry != nil && name != funcName(fn) {
+		return name
+	}
+	name = strings.TrimSuffix(name, "-fm")
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func (d *diagram) names(fns []interface{}, sep string) string {
+	names := []string{}
+	for _, fn := range fns {
+		names = append(names, d.name(fn))
+	}
+	return strings.Join(names, sep)
+}
+
+// highlighted returns true if the state is highlighted as active.
+func (d *diagram) highlighted(state *StateInstance) bool {
+	if !d.options.HighlightCurrent {
+		return false
+	}
+	for _, leaf := range d.hsm.leaves {
+		if leaf == state {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *diagram) line(depth int, format string, args ...interface{}) {
+	d.out.WriteString(strings.Repeat("  ", depth))
+	fmt.Fprintf(&d.out, format, args...)
+	d.out.WriteString("\n")
+}
+
+// ExportDOT writes the state machine as a Graphviz DOT digraph, drawing
+// composite states as nested clusters with a point marking their initial
+// child.
+func (hsm *Base) ExportDOT(options DiagramOptions) (string, error) {
+	d, err := hsm.newDiagram(options)
+	if err != nil {
+		return "", err
+	}
+	d.line(0, "digraph %q {", hsm.Name)
+	d.line(1, "compound=true;")
+	d.line(1, "node [shape=box, style=rounded];")
+	d.dotState(1, d.top)
+	d.dotEdges(1, nil)
+	d.line(0, "}")
+	return d.out.String(), nil
+}
+
+// dotNode returns the node used as the end of an edge to or from the
+// state: the initial point of a composite state's cluster.
+func dotNode(state *StateInstance) string {
+	if len(state.children) > 0 {
+		return string(state.Name) + "/initial"
+	}
+	return string(state.Name)
+}
+
+// dotState writes a state as a node, or a composite state as a cluster,
+// labelled with its name and internal transitions; %q escapes the label and
+// writes the line breaks between them as \n.
+func (d *diagram) dotState(depth int, state *StateInstance) {
+	label := strings.Join(append([]string{string(state.Name)},
+		d.internal[state]...), "\n")
+	if len(state.children) == 0 {
+		attrs := fmt.Sprintf("label=%q", label)
+		switch state.kind {
+		case shallowHistoryState:
+			attrs = "shape=circle, label=\"H\""
+		case deepHistoryState:
+			attrs = "shape=circle, label=\"H*\""
+		case choiceState:
+			attrs = "shape=diamond, label=\"\""
+		case junctionState:
+			attrs = "shape=point, width=0.15"
+		case entryPointState:
+			attrs = "shape=circle, width=0.2, label=\"\""
+		case exitPointState:
+			attrs = "shape=Mcircle, width=0.2, label=\"\""
+		case finalState:
+			attrs += ", shape=doublecircle"
+		}
+		if d.highlighted(state) {
+			attrs += ", style=\"rounded,filled\", fillcolor=yellow"
+		}
+		d.line(depth, "%q [%s];", state.Name, attrs)
+		return
+	}
+
+	d.line(depth, "subgraph %q {", "cluster_"+string(state.Name))
+	d.line(depth+1, "label=%q;", label)
+	if state.parallel {
+		d.line(depth+1, "style=dashed;")
+	}
+	d.line(depth+1, "%q [shape=point];", dotNode(state))
+	for _, child := range state.children {
+		d.dotState(depth+1, child)
+	}
+	if !state.parallel && state.initialState != "" {
+		initial := d.hsm.states[state.initialState]
+		d.line(depth+1, "%q -> %q%s;", dotNode(state), dotNode(initial),
+			dotAttrs(dotClip(nil, initial)))
+	}
+	d.dotEdges(depth+1, state)
+	d.line(depth, "}")
+}
+
+func (d *diagram) dotEdges(depth int, owner *StateInstance) {
+	for _, edge := range d.edges[owner] {
+		attrs := append([]string{fmt.Sprintf("label=%q", edge.label)},
+			dotClip(edge.source, edge.target)...)
+		d.line(depth, "%q -> %q%s;", dotNode(edge.source),
+			dotNode(edge.target), dotAttrs(attrs))
+	}
+}
+
+// dotAttrs returns the attribute list of a DOT statement.
+func dotAttrs(attrs []string) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(attrs, ", ") + "]"
+}
+
+// dotClip returns the ltail and lhead attributes clipping an edge at the
+// clusters of a composite source and target.
+func dotClip(source *StateInstance, target *StateInstance) []string {
+	attrs := []string{}
+	if source != nil && len(source.children) > 0 {
+		attrs = append(attrs, fmt.Sprintf("ltail=%q",
+			"cluster_"+string(source.Name)))
+	}
+	if len(target.children) > 0 {
+		attrs = append(attrs, fmt.Sprintf("lhead=%q",
+			"cluster_"+string(target.Name)))
+	}
+	return attrs
+}
+
+// ExportPlantUML writes the state machine as a PlantUML state diagram.
+// States whose names are not identifiers are declared with their name as
+// a label, as in Mermaid.
+func (hsm *Base) ExportPlantUML(options DiagramOptions) (string, error) {
+	d, err := hsm.newDiagram(options)
+	if err != nil {
+		return "", err
+	}
+	d.line(0, "@startuml")
+	d.line(0, "[*] --> %s", d.ids[d.top])
+	d.plantUMLState(0, d.top)
+	d.arrowEdges(0, nil)
+	d.line(0, "@enduml")
+	return d.out.String(), nil
+}
+
+func (d *diagram) plantUMLState(depth int, state *StateInstance) {
+	decl := "state " + d.declaration(state)
+	switch state.kind {
+	case shallowHistoryState:
+		decl += " <<history>>"
+	case deepHistoryState:
+		decl += " <<history*>>"
+	case choiceState, junctionState:
+		decl += " <<choice>>"
+	case entryPointState:
+		decl += " <<entryPoint>>"
+	case exitPointState:
+		decl += " <<exitPoint>>"
+	case finalState:
+		decl += " <<end>>"
+	}
+	if d.highlighted(state) {
+		decl += " #yellow"
+	}
+	if len(state.children) == 0 {
+		d.line(depth, "%s", decl)
+	} else {
+		d.line(depth, "%s {", decl)
+		for i, child := range state.children {
+			if state.parallel && i > 0 {
+				d.line(depth+1, "--")
+			}
+			if !state.parallel && child.Name == state.initialState {
+				d.line(depth+1, "[*] --> %s", d.ids[child])
+			}
+			d.plantUMLState(depth+1, child)
+		}
+		d.arrowEdges(depth+1, state)
+		d.line(depth, "}")
+	}
+	for _, label := range d.internal[state] {
+		d.line(depth, "%s : %s", d.ids[state], label)
+	}
+}
+
+// arrowEdges writes the edges drawn in the owner state as PlantUML and
+// Mermaid transitions between state identifiers.
+func (d *diagram) arrowEdges(depth int, owner *StateInstance) {
+	for _, edge := range d.edges[owner] {
+		source, target := d.ids[edge.source], d.ids[edge.target]
+		if edge.label == "" {
+			d.line(depth, "%s --> %s", source, target)
+			continue
+		}
+		d.line(depth, "%s --> %s : %s", source, target, edge.label)
+	}
+}
+
+// ExportMermaid writes the state machine as a Mermaid stateDiagram-v2.
+// Final states are drawn as states leading to the end of their composite
+// state, and junctions, entry points and exit points as choices.
+func (hsm *Base) ExportMermaid(options DiagramOptions) (string, error) {
+	d, err := hsm.newDiagram(options)
+	if err != nil {
+		return "", err
+	}
+	d.line(0, "stateDiagram-v2")
+	d.line(1, "[*] --> %s", d.ids[d.top])
+	d.mermaidState(1, d.top)
+	d.arrowEdges(1, nil)
+	if options.HighlightCurrent {
+		d.line(1, "classDef current fill:#ff0")
+		for _, leaf := range hsm.leaves {
+			if leaf != hsm.topState {
+				d.line(1, "class %s current", d.ids[leaf])
+			}
+		}
+	}
+	return d.out.String(), nil
+}
+
+func (d *diagram) mermaidState(depth int, state *StateInstance) {
+	id := d.ids[state]
+	switch state.kind {
+	case shallowHistoryState:
+		d.line(depth, "state \"H\" as %s", id)
+	case deepHistoryState:
+		d.line(depth, "state \"H*\" as %s", id)
+	case choiceState, junctionState, entryPointState, exitPointState:
+		d.line(depth, "state %s <<choice>>", id)
+	case finalState:
+		if id != string(state.Name) {
+			d.line(depth, "state %s", d.declaration(state))
+		}
+		d.line(depth, "%s --> [*]", id)
+	}
+	if len(state.children) > 0 {
+		if id != string(state.Name) {
+			d.line(depth, "state %s", d.declaration(state))
+		}
+		d.line(depth, "state %s {", id)
+		for i, child := range state.children {
+			if state.parallel && i > 0 {
+				d.line(depth+1, "--")
+			}
+			if !state.parallel && child.Name == state.initialState {
+				d.line(depth+1, "[*] --> %s", d.ids[child])
+			}
+			d.mermaidState(depth+1, child)
+		}
+		d.arrowEdges(depth+1, state)
+		d.line(depth, "}")
+	} else if state.kind == regularState {
+		if id != string(state.Name) {
+			d.line(depth, "state %s", d.declaration(state))
+		} else {
+			d.line(depth, "%s", id)
+		}
+	}
+	for _, label := range d.internal[state] {
+		d.line(depth, "%s : %s", id, label)
+	}
+}
@@ -0,0 +1,122 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evRedraw  hsm.Event = "redraw"
+	evRefresh hsm.Event = "refresh"
+	stScreen  hsm.State = `screen "main"`
+	stBlank   hsm.State = "blank"
+	stShowing hsm.State = "showing"
+	stSaver   hsm.State = "screen saver"
+)
+
+// newScreenHSM builds a screen whose showing state redraws itself through
+// a self transition and refreshes through an internal transition.  Blank
+// screens refresh to the screen saver.
+func newScreenHSM() *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("screenHSM")
+
+	screen := sm.NewState(stScreen)
+	blank := sm.NewState(stBlank)
+	blank.AddTransitions([]hsm.Transition{
+		{On: evRedraw, NewState: stShowing},
+		{On: evRefresh, NewState: stSaver}})
+	showing := sm.NewState(stShowing)
+	showing.AddTransitions([]hsm.Transition{
+		{On: evRedraw, NewState: stShowing},
+		{On: evRefresh}})
+	screen.AddChildren(blank, showing, sm.NewState(stSaver))
+
+	sm.Finalize()
+	return sm
+}
+
+func TestDiagrams(t *testing.T) {
+
+	Convey("CASE: Diagram Export", t, func() {
+		tr := &trace{}
+		sm := newPseudostatesHSM(tr)
+		sm.On()
+		options := hsm.DiagramOptions{HighlightCurrent: true}
+
+		Convey("1. DOT draws composite states as clusters\n", func() {
+			dot, err := sm.ExportDOT(options)
+			So(err, ShouldBeNil)
+			So(dot, ShouldStartWith, `digraph "pseudostatesHSM" {`)
+			So(dot, ShouldContainSubstring, `subgraph "cluster_router" {`)
+			So(dot, ShouldContainSubstring, `"router/initial" -> "ready";`)
+			So(dot, ShouldContainSubstring,
+				`"ready" [label="ready", style="rounded,filled", fillcolor=yellow];`)
+			So(dot, ShouldContainSubstring, `"choice" [shape=diamond, label=""];`)
+			So(dot, ShouldContainSubstring, `"choice" -> "routeC" [label="[else]"];`)
+		})
+
+		Convey("2. PlantUML nests states and marks initial children\n", func() {
+			uml, err := sm.ExportPlantUML(options)
+			So(err, ShouldBeNil)
+			So(uml, ShouldContainSubstring, "state router {\n  [*] --> ready\n")
+			So(uml, ShouldContainSubstring, "state choice <<choice>>\n")
+			So(uml, ShouldContainSubstring, "  choice --> routeC : [else]\n")
+			So(uml, ShouldContainSubstring, "state ready #yellow\n")
+		})
+
+		Convey("3. Mermaid writes a stateDiagram-v2\n", func() {
+			mermaid, err := sm.ExportMermaid(options)
+			So(err, ShouldBeNil)
+			So(mermaid, ShouldStartWith, "stateDiagram-v2\n  [*] --> router\n")
+			So(mermaid, ShouldContainSubstring, "\n  router --> routeC : jump\n")
+			So(mermaid, ShouldContainSubstring, "  class ready current\n")
+		})
+
+		Convey("4. Self and internal transitions are drawn on their state\n", func() {
+			screen := newScreenHSM()
+			dot, err := screen.ExportDOT(hsm.DiagramOptions{})
+			So(err, ShouldBeNil)
+			So(dot, ShouldContainSubstring, `subgraph "cluster_screen \"main\"" {`)
+			So(dot, ShouldContainSubstring, `label="screen \"main\"";`)
+			So(dot, ShouldContainSubstring, `"showing" [label="showing\nrefresh"];`)
+			So(dot, ShouldContainSubstring, `"showing" -> "showing" [label="redraw"];`)
+			uml, err := screen.ExportPlantUML(hsm.DiagramOptions{})
+			So(err, ShouldBeNil)
+			So(uml, ShouldContainSubstring, "  showing --> showing : redraw\n")
+			So(uml, ShouldContainSubstring, "  showing : refresh\n")
+			mermaid, err := screen.ExportMermaid(hsm.DiagramOptions{})
+			So(err, ShouldBeNil)
+			So(mermaid, ShouldContainSubstring, "    showing --> showing : redraw\n")
+			So(mermaid, ShouldContainSubstring, "    showing : refresh\n")
+		})
+
+		Convey("5. PlantUML and Mermaid label states not named as identifiers\n", func() {
+			screen := newScreenHSM()
+			screen.On()
+			screen.Inject(evRefresh, nil)
+			options := hsm.DiagramOptions{HighlightCurrent: true}
+			uml, err := screen.ExportPlantUML(options)
+			So(err, ShouldBeNil)
+			So(uml, ShouldContainSubstring, "[*] --> screen__main_\n")
+			So(uml, ShouldContainSubstring,
+				"state \"screen 'main'\" as screen__main_ {\n")
+			So(uml, ShouldContainSubstring,
+				"  state \"screen saver\" as screen_saver #yellow\n")
+			So(uml, ShouldContainSubstring,
+				"  blank --> screen_saver : refresh\n")
+			mermaid, err := screen.ExportMermaid(options)
+			So(err, ShouldBeNil)
+			So(mermaid, ShouldContainSubstring, "  [*] --> screen__main_\n"+
+				"  state \"screen 'main'\" as screen__main_\n"+
+				"  state screen__main_ {\n")
+			So(mermaid, ShouldContainSubstring,
+				"    state \"screen saver\" as screen_saver\n")
+			So(mermaid, ShouldContainSubstring,
+				"    blank --> screen_saver : refresh\n")
+			So(mermaid, ShouldContainSubstring, "  class screen_saver current\n")
+		})
+	})
+}
@@ -0,0 +1,24 @@
+module github.com/ckbaldy/hsm/example
+
+go 1.13
+
+require (
+	github.com/ckbaldy/hsm v0.0.0
+	github.com/ckbaldy/hsm/logrusadapter v0.0.0
+	github.com/sirupsen/logrus v1.9.3
+	github.com/smartystreets/goconvey v1.6.4
+	github.com/x-cray/logrus-prefixed-formatter v0.5.2
+)
+
+require (
+	github.com/mattn/go-colorable v0.1.4 // indirect
+	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
+	github.com/onsi/ginkgo v1.10.1 // indirect
+	github.com/onsi/gomega v1.7.0 // indirect
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550 // indirect
+)
+
+replace (
+	github.com/ckbaldy/hsm => ../
+	github.com/ckbaldy/hsm/logrusadapter => ../logrusadapter
+)
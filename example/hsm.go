@@ -3,6 +3,7 @@ package example
 import (
 	"github.com/ckbaldy/hsm"
 	"github.com/ckbaldy/hsm/example/logger"
+	"github.com/ckbaldy/hsm/logrusadapter"
 	"github.com/sirupsen/logrus"
 )
 
@@ -42,7 +43,7 @@ func NewHSM(name string) *HSM {
 	sm := &HSM{}
 	sm.Configure(name)
 	log.SetLevel(logrus.ErrorLevel)
-	sm.AddLogger(log)
+	sm.AddLogger(logrusadapter.New(log))
 
 	// State S0
 	s0 := sm.NewState(S0)
@@ -0,0 +1,224 @@
+package hsm_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evCharge    hsm.Event = "charge"
+	stPayment   hsm.State = "payment"
+	stCart      hsm.State = "cart"
+	stCharging  hsm.State = "charging"
+	stPaid      hsm.State = "paid"
+	stFailed    hsm.State = "failed"
+	failCharge            = "charge"
+	failPaid              = "paid"
+	failCartOut           = "cart"
+	evOpenVault hsm.Event = "openVault"
+	stVault     hsm.State = "vault"
+	stSealed    hsm.State = "sealed"
+	stUnsealed  hsm.State = "unsealed"
+	stAlarm     hsm.State = "alarm"
+	failBolt              = "bolt"
+	failLatch             = "latch"
+	failUnseal            = "unseal"
+	failAlarm             = "alarm"
+)
+
+var errDeclined = errors.New("declined")
+
+func (tr *trace) fail(name string, failing *string) hsm.ActionFunc {
+	return func(param interface{}) error {
+		*tr = append(*tr, name+" action")
+		if *failing == name {
+			return errDeclined
+		}
+		return nil
+	}
+}
+
+func (tr *trace) undo(name string) hsm.ActionFunc {
+	return func(param interface{}) error {
+		*tr = append(*tr, name+" undo")
+		return nil
+	}
+}
+
+// newFailureHSM builds a payment whose cart exits through charging to paid
+// on the charge event.  The action named by failing returns an error.
+func newFailureHSM(tr *trace, failing *string) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("failureHSM")
+	sm.SetErrorState(stFailed)
+
+	payment := sm.NewState(stPayment)
+	cart := sm.NewState(stCart)
+	cart.AddExitActions(tr.fail(failCartOut, failing))
+	cart.AddExitCompensations(tr.undo(failCartOut))
+	cart.AddTransitions([]hsm.Transition{
+		{On: evCharge, NewState: stPaid,
+			Action:       tr.fail(failCharge, failing),
+			Compensation: tr.undo(failCharge)},
+	})
+	paid := sm.NewState(stPaid)
+	paid.AddEntryActions(tr.fail(failPaid, failing))
+	paid.AddEntryCompensations(tr.undo(failPaid))
+	failed := sm.NewState(stFailed)
+	failed.AddEntryActions(tr.entry(string(stFailed)))
+
+	payment.AddChildren(cart, paid, failed)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestFailurePolicies(t *testing.T) {
+
+	Convey("CASE: Failure Policies", t, func() {
+		tr := &trace{}
+		failing := ""
+		sm := newFailureHSM(tr, &failing)
+		sm.On()
+		*tr = nil
+
+		Convey("1. A failed action stops the transition by default\n", func() {
+			failing = failCharge
+			err := sm.Inject(evCharge, nil)
+			So(err, ShouldNotBeNil)
+			So(errors.Is(err, errDeclined), ShouldBeTrue)
+			var tranErr *hsm.TransitionError
+			So(errors.As(err, &tranErr), ShouldBeTrue)
+			So(tranErr.Errors, ShouldHaveLength, 1)
+			So(tranErr.Errors[0].Phase, ShouldEqual, hsm.TransitionPhase)
+			So(sm.CurrentState, ShouldEqual, stCart)
+			So(*tr, ShouldResemble, trace{"cart action", "charge action"})
+		})
+
+		Convey("2. Compensations of completed actions run in reverse order\n", func() {
+			sm.SetFailurePolicy(hsm.CompensateOnFailure)
+			failing = failPaid
+			So(sm.Inject(evCharge, nil), ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stCart)
+			So(*tr, ShouldResemble, trace{"cart action", "charge action",
+				"paid action", "charge undo", "cart undo"})
+			failing = ""
+			So(sm.Inject(evCharge, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stPaid)
+		})
+
+		Convey("3. Transitions continue past failed actions when asked to\n", func() {
+			sm.SetFailurePolicy(hsm.ContinueOnFailure)
+			failing = failCartOut
+			err := sm.Inject(evCharge, nil)
+			So(err, ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stPaid)
+			So(*tr, ShouldResemble, trace{"cart action", "charge action",
+				"paid action"})
+		})
+
+		Convey("4. A failed action leads to the error state when one is set\n", func() {
+			sm.SetFailurePolicy(hsm.ErrorStateOnFailure)
+			failing = failPaid
+			So(sm.Inject(evCharge, nil), ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stFailed)
+			So(*tr, ShouldResemble, trace{"cart action", "charge action",
+				"paid action", "failed entry"})
+		})
+
+		Convey("5. The error state policy needs an existing error state\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("noErrorStateHSM")
+			sm.SetFailurePolicy(hsm.ErrorStateOnFailure)
+			payment := sm.NewState(stPayment)
+			payment.AddChildren(sm.NewState(stCart))
+			So(sm.Finalize(), ShouldNotBeNil)
+			sm.SetErrorState(stFailed)
+			So(sm.Validate().Errors(), ShouldResemble, []hsm.Problem{
+				{Severity: hsm.SeverityError, State: stFailed,
+					Message: "error state does not exist"},
+			})
+		})
+
+		Convey("6. Without an error state, a failed action stops the transition\n", func() {
+			sm.SetFailurePolicy(hsm.ErrorStateOnFailure)
+			sm.SetErrorState("")
+			failing = failPaid
+			So(sm.Inject(evCharge, nil), ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stCart)
+			So(*tr, ShouldResemble, trace{"cart action", "charge action",
+				"paid action"})
+		})
+	})
+}
+
+// newRollbackHSM builds a vault whose sealed state raises the alarm after
+// 5s.  Its exit actions, bolt then latch, each have a compensation.  The
+// action named by failing returns an error.
+func newRollbackHSM(tr *trace, clock hsm.Clock, failing *string) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("rollbackHSM")
+	sm.SetClock(clock)
+	sm.SetFailurePolicy(hsm.CompensateOnFailure)
+
+	vault := sm.NewState(stVault)
+	sealed := sm.NewState(stSealed)
+	sealed.AddExitActions(tr.fail(failBolt, failing),
+		tr.fail(failLatch, failing))
+	sealed.AddExitCompensations(tr.undo(failBolt), tr.undo(failLatch))
+	sealed.AddTransitions([]hsm.Transition{
+		{On: evOpenVault, NewState: stUnsealed},
+		{On: hsm.After(5 * time.Second), NewState: stAlarm},
+	})
+	unsealed := sm.NewState(stUnsealed)
+	unsealed.AddEntryActions(tr.fail(failUnseal, failing))
+	alarm := sm.NewState(stAlarm)
+	alarm.AddEntryActions(tr.fail(failAlarm, failing))
+
+	vault.AddChildren(sealed, unsealed, alarm)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestRollback(t *testing.T) {
+
+	Convey("CASE: Rollback of Compensated Transitions", t, func() {
+		tr := &trace{}
+		failing := ""
+		clock := hsm.NewFakeClock(time.Unix(0, 0))
+		sm := newRollbackHSM(tr, clock, &failing)
+		sm.On()
+		*tr = nil
+
+		Convey("1. Only the state actions that completed are compensated\n", func() {
+			failing = failLatch
+			So(sm.Inject(evOpenVault, nil), ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stSealed)
+			So(*tr, ShouldResemble, trace{"bolt action", "latch action",
+				"bolt undo"})
+		})
+
+		Convey("2. Timers cancelled by the transition resume where they were\n", func() {
+			failing = failUnseal
+			clock.Advance(3 * time.Second)
+			So(sm.Inject(evOpenVault, nil), ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stSealed)
+			clock.Advance(2 * time.Second)
+			So(sm.CurrentState, ShouldEqual, stAlarm)
+		})
+
+		Convey("3. Timers that fired are not armed again\n", func() {
+			failing = failAlarm
+			clock.Advance(5 * time.Second)
+			So(sm.CurrentState, ShouldEqual, stSealed)
+			*tr = nil
+			clock.Advance(10 * time.Second)
+			So(*tr, ShouldBeEmpty)
+		})
+	})
+}
@@ -0,0 +1,103 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evNext      hsm.Event = "next"
+	evFinishA   hsm.Event = "finishA"
+	evFinishB   hsm.Event = "finishB"
+	evBatch     hsm.Event = "batch"
+	stWorkflow  hsm.State = "workflow"
+	stProcess   hsm.State = "process"
+	stStep1     hsm.State = "step1"
+	stStep2     hsm.State = "step2"
+	stStepsDone hsm.State = "stepsDone"
+	stBatch     hsm.State = "batchJob"
+	stJobA      hsm.State = "jobA"
+	stJobB      hsm.State = "jobB"
+	stRunA      hsm.State = "runA"
+	stRunB      hsm.State = "runB"
+	stDoneA     hsm.State = "doneA"
+	stDoneB     hsm.State = "doneB"
+	stFinished  hsm.State = "finished"
+)
+
+// newFinalHSM builds a workflow whose process moves on to finished when its
+// steps reach their final state, and whose batch job moves on to finished
+// when both of its orthogonal jobs reach their final states.
+func newFinalHSM(tr *trace) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("finalHSM")
+
+	workflow := sm.NewState(stWorkflow)
+	process := sm.NewState(stProcess)
+	process.AddExitActions(tr.exit(string(stProcess)))
+	process.AddTransitions([]hsm.Transition{
+		{On: evBatch, NewState: stBatch},
+		// Completion transition
+		{NewState: stFinished, Action: tr.action("completion")},
+	})
+	step1 := sm.NewState(stStep1)
+	step1.AddTransitions([]hsm.Transition{{On: evNext, NewState: stStep2}})
+	step2 := sm.NewState(stStep2)
+	step2.AddTransitions([]hsm.Transition{{On: evNext, NewState: stStepsDone}})
+	stepsDone := sm.NewFinalState(stStepsDone)
+	stepsDone.AddEntryActions(tr.entry(string(stStepsDone)))
+
+	batch := sm.NewState(stBatch)
+	batch.AddTransitions([]hsm.Transition{{NewState: stFinished}})
+	jobA := sm.NewState(stJobA)
+	runA := sm.NewState(stRunA)
+	runA.AddTransitions([]hsm.Transition{{On: evFinishA, NewState: stDoneA}})
+	doneA := sm.NewFinalState(stDoneA)
+	jobB := sm.NewState(stJobB)
+	runB := sm.NewState(stRunB)
+	runB.AddTransitions([]hsm.Transition{{On: evFinishB, NewState: stDoneB}})
+	doneB := sm.NewFinalState(stDoneB)
+
+	finished := sm.NewState(stFinished)
+
+	workflow.AddChildren(process, batch, finished)
+	process.AddChildren(stepsDone, step1, step2)
+	batch.AddRegions(jobA, jobB)
+	jobA.AddChildren(runA, doneA)
+	jobB.AddChildren(runB, doneB)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestFinalStates(t *testing.T) {
+
+	Convey("CASE: Final States and Completion Events", t, func() {
+		tr := &trace{}
+		sm := newFinalHSM(tr)
+		sm.On()
+		*tr = nil
+
+		Convey("1. Final states are never the default state\n", func() {
+			So(sm.CurrentState, ShouldEqual, stStep1)
+		})
+
+		Convey("2. Entering a final state completes its composite\n", func() {
+			So(sm.Inject(evNext, nil), ShouldBeNil)
+			So(sm.Inject(evNext, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stFinished)
+			So(*tr, ShouldResemble, trace{"stepsDone entry", "process exit",
+				"completion action"})
+		})
+
+		Convey("3. An orthogonal state completes when every region completes\n", func() {
+			sm.Inject(evBatch, nil)
+			So(sm.Inject(evFinishA, nil), ShouldBeNil)
+			So(sm.ActiveStates(), ShouldResemble, []hsm.State{stDoneA, stRunB})
+			So(sm.Inject(evFinishB, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stFinished)
+		})
+	})
+}
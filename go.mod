@@ -1,3 +1,8 @@
 module github.com/ckbaldy/hsm
 
 go 1.13
+
+require (
+	github.com/smartystreets/goconvey v1.6.4
+	gopkg.in/yaml.v2 v2.4.0
+)
@@ -0,0 +1,87 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evGrade   hsm.Event = "grade"
+	evBonus   hsm.Event = "bonus"
+	evReset   hsm.Event = "reset"
+	stGrading hsm.State = "grading"
+	stWaiting hsm.State = "waiting"
+	stGradeA  hsm.State = "gradeA"
+	stGradeB  hsm.State = "gradeB"
+	stGradeF  hsm.State = "gradeF"
+)
+
+func atLeast(score int) hsm.GuardFunc {
+	return func(param interface{}) (bool, error) {
+		return param.(int) >= score, nil
+	}
+}
+
+// newGuardsHSM builds a grading state whose waiting state branches on the
+// score passed with the grade event.
+func newGuardsHSM() *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("guardsHSM")
+
+	grading := sm.NewState(stGrading)
+	grading.AddTransitions([]hsm.Transition{
+		{On: evReset, NewState: stWaiting},
+		{On: evBonus, NewState: stGradeB, Guard: atLeast(50)},
+	})
+	waiting := sm.NewState(stWaiting)
+	waiting.AddTransitions([]hsm.Transition{
+		// The else branch is evaluated last, wherever it is declared.
+		{On: evGrade, NewState: stGradeF, Else: true},
+		{On: evGrade, NewState: stGradeA, Guard: atLeast(90)},
+		{On: evGrade, NewState: stGradeB, Guard: atLeast(70)},
+		{On: evBonus, NewState: stGradeA, Guard: atLeast(95)},
+	})
+	gradeA := sm.NewState(stGradeA)
+	gradeB := sm.NewState(stGradeB)
+	gradeF := sm.NewState(stGradeF)
+
+	grading.AddChildren(waiting, gradeA, gradeB, gradeF)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestGuardedTransitions(t *testing.T) {
+
+	Convey("CASE: Multiple Guarded Transitions per Event", t, func() {
+		sm := newGuardsHSM()
+		sm.On()
+
+		Convey("1. First guard returning true wins\n", func() {
+			So(sm.Inject(evGrade, 95), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stGradeA)
+		})
+
+		Convey("2. Guards are evaluated in declaration order\n", func() {
+			So(sm.Inject(evGrade, 75), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stGradeB)
+		})
+
+		Convey("3. Else branch is taken when every guard rejects\n", func() {
+			So(sm.Inject(evGrade, 10), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stGradeF)
+		})
+
+		Convey("4. Event is dropped when every guard rejects without an else\n", func() {
+			So(sm.Inject(evBonus, 10), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stWaiting)
+		})
+
+		Convey("5. Event falls through to the parent when the child's guard rejects\n", func() {
+			So(sm.Inject(evBonus, 60), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stGradeB)
+		})
+	})
+}
@@ -0,0 +1,109 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evToA      hsm.Event = "toA"
+	evToB22    hsm.Event = "toB22"
+	evShallow  hsm.Event = "shallow"
+	evDeep     hsm.Event = "deep"
+	evToB      hsm.Event = "toB"
+	stP        hsm.State = "p"
+	stA        hsm.State = "a"
+	stB        hsm.State = "b"
+	stB1       hsm.State = "b1"
+	stB2       hsm.State = "b2"
+	stB21      hsm.State = "b21"
+	stB22      hsm.State = "b22"
+	stBShallow hsm.State = "bShallow"
+	stBDeep    hsm.State = "bDeep"
+)
+
+// newHistoryHSM builds:
+//
+//	p
+//	├── a
+//	└── b (shallow and deep history)
+//	    ├── b1
+//	    └── b2
+//	        ├── b21
+//	        └── b22
+func newHistoryHSM() *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("historyHSM")
+
+	p := sm.NewState(stP)
+	a := sm.NewState(stA)
+	a.AddTransitions([]hsm.Transition{
+		{On: evShallow, NewState: stBShallow},
+		{On: evDeep, NewState: stBDeep},
+		{On: evToB, NewState: stB},
+	})
+	b := sm.NewState(stB)
+	b.AddTransitions([]hsm.Transition{
+		{On: evToA, NewState: stA},
+		{On: evToB22, NewState: stB22},
+	})
+	b1 := sm.NewState(stB1)
+	b2 := sm.NewState(stB2)
+	b21 := sm.NewState(stB21)
+	b22 := sm.NewState(stB22)
+	shallow := sm.NewShallowHistory(stBShallow)
+	deep := sm.NewDeepHistory(stBDeep)
+
+	p.AddChildren(a, b)
+	b.AddChildren(shallow, deep, b1, b2)
+	b2.AddChildren(b21, b22)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestHistory(t *testing.T) {
+
+	Convey("CASE: History Pseudostates", t, func() {
+		Convey("1. Default entry when no history is recorded\n", func() {
+			sm := newHistoryHSM()
+			So(sm.On(), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stA)
+			So(sm.Inject(evShallow, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stB1)
+		})
+
+		Convey("2. Shallow history resumes the last active child\n", func() {
+			sm := newHistoryHSM()
+			sm.On()
+			sm.Inject(evToB, nil)
+			sm.Inject(evToB22, nil)
+			sm.Inject(evToA, nil)
+			So(sm.CurrentState, ShouldEqual, stA)
+			So(sm.Inject(evShallow, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stB21)
+		})
+
+		Convey("3. Deep history resumes the last active leaf\n", func() {
+			sm := newHistoryHSM()
+			sm.On()
+			sm.Inject(evToB, nil)
+			sm.Inject(evToB22, nil)
+			sm.Inject(evToA, nil)
+			So(sm.Inject(evDeep, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stB22)
+		})
+
+		Convey("4. Targeting the composite ignores history\n", func() {
+			sm := newHistoryHSM()
+			sm.On()
+			sm.Inject(evToB, nil)
+			sm.Inject(evToB22, nil)
+			sm.Inject(evToA, nil)
+			So(sm.Inject(evToB, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stB1)
+		})
+	})
+}
@@ -13,13 +13,10 @@ package hsm
 // TODO:  complete README.
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
-	"reflect"
-	"runtime"
 	"sync"
-
-	"github.com/sirupsen/logrus"
+	"time"
 )
 
 // Event is the type for triggers
@@ -43,37 +40,80 @@ const (
 	hsmInitEvent Event = "InitialTransition"
 	// ExitEvent causes the default transition to the final pseudostate
 	hsmExitEvent Event = "ExitTransition"
+	// SubmachineEvent reports what the sub-machines did on their own
+	hsmSubmachineEvent Event = "SubmachineEvent"
 	// TopState manages entry/exit into/from the define top state machine
 	hsmTopState State = "TopState"
 )
 
 // Base object for HSM
 type Base struct {
-	Name         string
-	CurrentState State
-	states       map[State]*StateInstance
-	topState     *StateInstance
-	runState     hsmConfigState
-	logger       *logrus.Logger
-	log          *logrus.Entry
+	Name            string
+	CurrentState    State
+	states          map[State]*StateInstance
+	topState        *StateInstance
+	runState        hsmConfigState
+	history         map[State][]State
+	leaves          []*StateInstance
+	completions     []*StateInstance
+	queue           []queuedEvent
+	deferred        []queuedEvent
+	clock           Clock
+	timers          map[*StateInstance][]*armedTimer
+	failurePolicy   FailurePolicy
+	errorState      State
+	definition      *Definition
+	redefined       []State
+	listeners       []Listener
+	codec           ParamCodec
+	store           Store
+	storeID         string
+	journal         Journal
+	journalSeq      uint64
+	replaying       bool
+	suppressActions bool
+	ctx             context.Context
+	instance        *Instance
+	submachines     map[*StateInstance]*Instance
+	owner           *Base
+	completed       bool
+	reports         []submachineReport
+	queueLock       sync.Mutex
+	queueSignal     chan struct{}
+	stopLoop        chan struct{}
+	loopDone        chan struct{}
+	logger          Logger
+	log             Logger
 	sync.Mutex
 }
 
 // Configure initializes the state machine, creating a state machine map
 // This must be called once prior to intializing or defining the states,
-// their transitions and child/parent relations.
+// their transitions and child/parent relations.  A machine sharing a
+// compiled Definition cannot be configured.
 func (hsm *Base) Configure(name string) {
+	if hsm.definition != nil {
+		hsm.log.Error(fmt.Sprintf(
+			"cannot configure hsm %s; its definition is compiled", hsm.Name))
+		return
+	}
+	// States redefined in an earlier configuration were already reported.
+	hsm.redefined = nil
 	if hsm.states == nil {
 		hsm.Name = name
 		hsm.states = make(map[State]*StateInstance)
+		hsm.history = make(map[State][]State)
+		hsm.queueSignal = make(chan struct{}, 1)
+		hsm.clock = realClock{}
+		hsm.timers = make(map[*StateInstance][]*armedTimer)
 		hsm.DisableLogger()
 	}
 	hsm.runState = INITIALIZING
 }
 
-// AddLogger adds an externally defined logrus logger,  enabling logging of
-// state machine transitions.
-func (hsm *Base) AddLogger(externalLogger *logrus.Logger) {
+// AddLogger adds an externally defined logger,  enabling logging of state
+// machine transitions.  See Logger for the adapters provided.
+func (hsm *Base) AddLogger(externalLogger Logger) {
 	hsm.logger = externalLogger
 	hsm.addLoggerEntry()
 }
@@ -81,67 +121,67 @@ func (hsm *Base) AddLogger(externalLogger *logrus.Logger) {
 // DisableLogger disables state machine transition logging, removing
 // the previously added logger.
 func (hsm *Base) DisableLogger() {
-	hsm.logger = logrus.New()
-	hsm.logger.Out = ioutil.Discard
+	hsm.logger = nopLogger{}
 	hsm.addLoggerEntry()
 }
 
-// Finalize verifies the top state and disables further configuration.
-// Configuration can later be changed by calling 'Configure' again.
-// An error is returned if children relationships have not be created.
+// Finalize validates the states, see Validate, and disables further
+// configuration.  Configuration can later be changed by calling 'Configure'
+// again.  The validation report is returned as the error if it has errors;
+// warnings are only logged.
 func (hsm *Base) Finalize() error {
 
-	var err error
-	var numStatesWithParent int
-	topStates := []*StateInstance{}
+	if hsm.definition != nil {
+		err := fmt.Errorf("cannot finalize hsm %s; its definition is compiled",
+			hsm.Name)
+		hsm.log.Error(err)
+		return err
+	}
 
-	for _, state := range hsm.states {
-		if state.parent == nil {
-			topStates = append(topStates, state)
+	report := hsm.Validate()
+	for _, problem := range report.Problems {
+		if problem.Severity == SeverityError {
+			hsm.log.Error(problem)
 		} else {
-			numStatesWithParent++
+			hsm.log.Warn(problem)
 		}
 	}
+	if report.HasErrors() {
+		return report
+	}
 
-	// There should be only be one, least common ancestor after all state
-	// parent/child relationships definitions have been finalized  and all
-	// other states must have defined parent.
-	if len(topStates) == 1 && numStatesWithParent == (len(hsm.states)-1) {
-
+	// There is only one, least common ancestor after all state parent/child
+	// relationships definitions have been finalized.  The top state
+	// managing it is added once, when first finalized.
+	if hsm.topState == nil {
+		var top *StateInstance
+		for _, state := range hsm.configuredStates() {
+			if state.parent == nil {
+				top = state
+			}
+		}
 		hsm.topState = hsm.NewState(hsmTopState)
 		hsm.topState.AddTransitions([]Transition{
 			{On: hsmInitEvent, NewState: hsm.topState.Name}})
-		topStates[0].AddTransitions([]Transition{
+		top.AddTransitions([]Transition{
 			{On: hsmExitEvent, NewState: hsm.topState.Name}})
 		// The initial child state is the user configured, top state.
-		hsm.topState.AddChildren(topStates[0])
-
-		hsm.CurrentState = hsm.topState.Name
-		hsm.runState = FINALIZED
-
-	} else if numStatesWithParent == 0 {
-		err = fmt.Errorf("no child states were added in %s", hsm.Name)
-		hsm.log.Error(err)
-
-	} else if len(topStates) > 1 {
-		// There is more than one state with an undefined parent.  This
-		// is not allowed.
-		var topStateNames State
-		for _, state := range topStates {
-			topStateNames += state.Name + ", "
-		}
-		err = fmt.Errorf("found more than one top state in %s %s",
-			hsm.Name, topStateNames)
-		hsm.log.Error(err)
-		hsm.log.Errorf("there needs to be a parent defined for every state" +
-			" except the top state")
+		hsm.topState.AddChildren(top)
 	}
-	return err
+	hsm.topState.setDocumentOrder(0)
+
+	hsm.leaves = []*StateInstance{hsm.topState}
+	hsm.CurrentState = hsm.topState.Name
+	hsm.runState = FINALIZED
+	return nil
 }
 
 // On starts a finalized state machine, using the initial, default transtition
 // for the top state.
 func (hsm *Base) On() error {
+	hsm.Lock()
+	defer hsm.Unlock()
+
 	var err error
 	if hsm.runState == FINALIZED || hsm.runState == OFF {
 		currentState, err := hsm.lookupState(hsm.CurrentState)
@@ -150,7 +190,7 @@ func (hsm *Base) On() error {
 		}
 		if currentState == hsm.topState {
 			hsm.runState = ON
-			hsm.Inject(hsmInitEvent, nil)
+			hsm.inject(context.Background(), hsmInitEvent, nil)
 		}
 	} else {
 		err = fmt.Errorf("cannot start hsm %s; it is not finalized", hsm.Name)
@@ -160,8 +200,12 @@ func (hsm *Base) On() error {
 }
 
 // Off exits (turns off) the state machine, running all the required exit
-// actions and setting the hsm run state to off.
+// actions and setting the hsm run state to off.  Posted and deferred events
+// that have not been dispatched are discarded.
 func (hsm *Base) Off() error {
+	hsm.Lock()
+	defer hsm.Unlock()
+
 	var err error
 	if hsm.runState == ON {
 		currentState, err := hsm.lookupState(hsm.CurrentState)
@@ -170,8 +214,12 @@ func (hsm *Base) Off() error {
 		}
 		if currentState != hsm.topState {
 			hsm.runState = EXITING
-			hsm.Inject(hsmExitEvent, nil)
+			hsm.inject(context.Background(), hsmExitEvent, nil)
 			hsm.runState = OFF
+			hsm.clearQueue()
+			if hsm.store != nil {
+				return hsm.checkpoint()
+			}
 		}
 	} else {
 		err = fmt.Errorf("cannot start hsm %s; it is not finalized", hsm.Name)
@@ -181,13 +229,13 @@ func (hsm *Base) Off() error {
 }
 
 func (hsm *Base) addLoggerEntry() {
-	hsm.log = hsm.logger.WithFields(logrus.Fields{"prefix": hsm.Name})
+	hsm.log = hsm.logger.WithFields(Fields{"prefix": hsm.Name})
 }
 
 func (hsm *Base) lookupState(name State) (*StateInstance, error) {
 	state, ok := hsm.states[name]
 	if !ok {
-		hsm.log.WithFields(logrus.Fields{
+		hsm.log.WithFields(Fields{
 			"state": name,
 		}).Debug("state not found")
 		return nil, fmt.Errorf("state %s not found for %s", name, hsm.Name)
@@ -196,13 +244,69 @@ func (hsm *Base) lookupState(name State) (*StateInstance, error) {
 }
 
 // Inject event into HSM. Return an error if the event/transition is not found.
+// Events posted by the actions run for the event are dispatched before
+// Inject returns.  Actions must use Post rather than Inject, which would
+// deadlock.
 func (hsm *Base) Inject(event Event, param interface{}) error {
+	return hsm.InjectContext(context.Background(), event, param)
+}
+
+// InjectContext injects an event as Inject does, passing the context to the
+// context-aware actions and guards run for the event, see ContextActionFunc
+// and ContextGuardFunc.  If the context is done before an action runs, the
+// transition stops, whatever the failure policy, and a TransitionError
+// wrapping the context's error, context.Canceled or
+// context.DeadlineExceeded, is returned.  No event is dispatched if the
+// context is already done.
+func (hsm *Base) InjectContext(ctx context.Context, event Event,
+	param interface{}) error {
 
 	// Ensure run to completion (RTC) in a concurrent environment; the last
 	// event/transtion sequence must run to completion before starting the
 	// next transition.
 	hsm.Lock()
 	defer hsm.Unlock()
+	return hsm.inject(ctx, event, param)
+}
+
+// inject implements InjectContext.  The caller must hold the RTC lock.
+func (hsm *Base) inject(ctx context.Context, event Event,
+	param interface{}) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if hsm.runState == ON || hsm.runState == EXITING {
+		if err := hsm.record(event, param); err != nil {
+			return err
+		}
+	}
+	hsm.ctx = ctx
+	err := hsm.dispatch(event, param)
+	hsm.dispatchDeferred()
+	hsm.ctx = nil
+	if checkpointErr := hsm.checkpointStep(); err == nil {
+		err = checkpointErr
+	}
+	hsm.dispatchQueued()
+	return err
+}
+
+// context returns the context of the event being injected, carrying the
+// running instance, if any.
+func (hsm *Base) context() context.Context {
+	ctx := hsm.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if hsm.instance != nil {
+		ctx = context.WithValue(ctx, instanceKey{}, hsm.instance)
+	}
+	return ctx
+}
+
+// dispatch runs the event to completion.  The caller must hold the RTC lock.
+func (hsm *Base) dispatch(event Event, param interface{}) error {
 
 	if hsm.runState != ON && hsm.runState != EXITING {
 		err := fmt.Errorf("cannot inject events into hsm %s; it is not on",
@@ -210,224 +314,530 @@ func (hsm *Base) Inject(event Event, param interface{}) error {
 		hsm.log.Error(err)
 		return err
 	}
+	if event == hsmSubmachineEvent {
+		return hsm.dispatchReports()
+	}
+	hsm.notify(Observation{Kind: EventReceived, Event: event,
+		State: hsm.CurrentState, Param: param}, time.Time{})
 
-	// Find the first composite state in the state tree that has a defined
-	// transition for the event.
-	sourceState, tran, exitActions, err := hsm.eventSource(event)
+	consumed, err := hsm.dispatchSubmachines(event, param)
 	if err != nil {
 		return err
 	}
+	enabled, handled, err := hsm.enabledTransitions(event, param, consumed)
+	if err != nil {
+		return err
+	}
+	if len(enabled) == 0 && len(consumed) > 0 {
+		return hsm.dispatchCompletions()
+	}
+
+	// Keep the event if no transition is taken and an active state defers
+	// it.
+	if len(enabled) == 0 && hsm.isDeferred(event) {
+		hsm.deferred = append(hsm.deferred, queuedEvent{event, param, hsm.ctx})
+		hsm.log.WithFields(Fields{
+			"state": hsm.CurrentState,
+			"on":    event,
+		}).Debug("event deferred")
+		return nil
+	}
+
+	if !handled {
+		// Top state reached. A matching event was not found in the state tree.
+		// A sub-machine passes the event on to the machine owning it.
+		entry := hsm.log.WithFields(Fields{
+			"state": hsm.CurrentState,
+			"on":    event,
+		})
+		if hsm.owner != nil {
+			entry.Debug("unhandled event/transition passed to owner")
+		} else {
+			entry.Error("unhandled event/transition")
+		}
+		err := fmt.Errorf("%w in %s,"+
+			"current state:%s, event: %s", ErrUnhandledEvent, hsm.Name,
+			hsm.CurrentState, event)
+		hsm.notify(Observation{Kind: EventUnhandled, Event: event,
+			State: hsm.CurrentState, Param: param, Err: err}, time.Time{})
+		return err
+	}
 
-	// A transiton was found.  If transition has a guard and the guard
-	// returns true, apply the transition.
-	if tran.Guard != nil {
-		tranAllowed, err := tran.Guard(param)
+	// Apply the transitions in region (document) order.  A transition whose
+	// source state was exited by an earlier transition is in conflict and
+	// is discarded.
+	for _, et := range enabled {
+		if !hsm.isActive(et.source) {
+			continue
+		}
+		err := hsm.applyTransition(et.segments, param, et.source)
 		if err != nil {
-			hsm.logAction("guard function failed", tran, tran.Guard, param)
+			hsm.completions = nil
 			return err
 		}
-		if !tranAllowed {
-			hsm.logAction("transition guarded", tran, tran.Guard, param)
-			return nil
+	}
+	return hsm.dispatchCompletions()
+}
+
+// enabledTransitions finds, for each active leaf state, the first composite
+// state in the state tree with a transition for the event allowed by its
+// guard.  Leaves in orthogonal regions sharing a composite ancestor evaluate
+// its transitions only once.  It also returns whether any active state
+// defines a transition for the event.  The consumed leaves, whose
+// sub-machine handled the event, are skipped.
+func (hsm *Base) enabledTransitions(event Event, param interface{},
+	consumed []*StateInstance) ([]enabledTransition, bool, error) {
+
+	var handled bool
+	selected := make(map[*StateInstance][]*Transition)
+	enabled := []enabledTransition{}
+	for _, leaf := range hsm.leaves {
+		if containsState(consumed, leaf) {
+			continue
+		}
+		sourceState, segments, found, err := hsm.eventSource(leaf, event,
+			param, selected)
+		if err != nil {
+			return nil, handled, err
 		}
+		handled = handled || found
+		if segments == nil || isSelected(enabled, sourceState) {
+			continue
+		}
+		enabled = append(enabled, enabledTransition{sourceState, segments})
 	}
-	return hsm.applyTransition(tran, exitActions, param, sourceState)
+	return enabled, handled, nil
 }
 
-// eventSource searches the composite state tree for a state that can handle
-// (has a transition defined for) the event. The search begins with the current
-// state  and proceeds up the state tree until either a transition is found or
-// the top state is reached. If an event transition is found, it returns the
-// source state handling the event, the event transition and the exit actions
-// for states in the state tree, starting at the current state up to and
-// including  the source state.  An 'unhandled event' error is returned if a
-// transition is not found.
-func (hsm *Base) eventSource(event Event) (*StateInstance,
-	*Transition, []ActionFunc, error) {
-
-	currentState, err := hsm.lookupState(hsm.CurrentState)
-	if err != nil {
-		return nil, nil, nil, err
+// dispatchCompletions takes the completion transitions, those with an empty
+// On event, of the composite states that completed during the last
+// transition, until no completion events remain.  Completion events are
+// dispatched before any other event and carry no param.
+func (hsm *Base) dispatchCompletions() error {
+	for len(hsm.completions) > 0 {
+		state := hsm.completions[0]
+		hsm.completions = hsm.completions[1:]
+		if !hsm.isActive(state) {
+			continue
+		}
+		segments, err := hsm.selectTransition(state, "", nil)
+		if err == nil && segments != nil {
+			err = hsm.applyTransition(segments, nil, state)
+		}
+		if err != nil {
+			hsm.completions = nil
+			return err
+		}
 	}
+	return nil
+}
 
-	// If there is a direct transition for the current state ...
-	tran, ok := currentState.transitions[event]
-	if ok {
-		return currentState, tran, currentState.exitActions, nil
+// enabledTransition pairs a transition selected for an event with the
+// state that handles it.  A transition through junction pseudostates is made
+// of several segments, the first being the transition triggered by the
+// event.
+type enabledTransition struct {
+	source   *StateInstance
+	segments []*Transition
+}
+
+// isSelected returns true if a transition from the source state is already
+// in the enabled list.
+func isSelected(enabled []enabledTransition, source *StateInstance) bool {
+	for _, et := range enabled {
+		if et.source == source {
+			return true
+		}
 	}
+	return false
+}
 
-	// Walk parents looking for a matching transition event for the state,
-	// appending any exit actions required while progressing up the tree.
-	parent := currentState.parent
-	exitActions := currentState.exitActions
-	for parent != nil {
-		tran, ok := parent.transitions[event]
-		if !ok {
-			// If event is not defined for the state, append exit actions
-			// for the parent and proceed up the tree.
-			exitActions = append(exitActions, parent.exitActions...)
-			parent = parent.parent
+// eventSource searches the composite state tree for a state that can handle
+// (has a transition defined for) the event. The search begins with the given
+// active leaf state and proceeds up the state tree until either a transition
+// allowed by its guard is found or the top state is reached.  A state whose
+// transitions are all rejected by their guards passes the event on to its
+// parent.  It returns the source state and the segments of its transition,
+// if one is allowed, and whether any state defines a transition for the
+// event.  The transition selected for each state is cached in selected.
+func (hsm *Base) eventSource(leaf *StateInstance, event Event,
+	param interface{}, selected map[*StateInstance][]*Transition) (
+	*StateInstance, []*Transition, bool, error) {
+
+	var handled bool
+	// Walk parents looking for a matching transition event for the state.
+	for state := leaf; state != nil; state = state.parent {
+		if len(state.transitions[event]) == 0 {
 			continue
-		} else {
-			// Event found.
-			sourceState := parent
-			return sourceState, tran, exitActions, nil
+		}
+		handled = true
+		segments, ok := selected[state]
+		if !ok {
+			var err error
+			segments, err = hsm.selectTransition(state, event, param)
+			if err != nil {
+				return nil, nil, handled, err
+			}
+			selected[state] = segments
+		}
+		if segments != nil {
+			return state, segments, handled, nil
 		}
 	}
-	// Top state reached. A matching event was not found in the state tree.
-	hsm.log.WithFields(logrus.Fields{
-		"state": hsm.CurrentState,
-		"on":    event,
-	}).Error("unhandled event/transition")
-	err = fmt.Errorf("unhandled event/transition in %s,"+
-		"current state:%s, event: %s", hsm.Name, hsm.CurrentState, event)
-	return nil, nil, nil, err
+	return nil, nil, handled, nil
 }
 
-// leastCommonAncestor finds the exit and entry actions for the
-// transition based on the common parent or the least common ancestor (LCA)
-// for the source and target states.
-func (hsm *Base) leastCommonAncestor(sourceState *StateInstance,
-	targetState *StateInstance) ([]ActionFunc, []ActionFunc, error) {
-
-	var err error
-	var lca *StateInstance
+// selectTransition evaluates, in declaration order, the guards of the
+// state's transitions for the event and returns the segments of the first
+// transition allowed.  A transition without a guard is always allowed.  The
+// else transition, if any, is taken when every other guard rejects the
+// event; otherwise nil is returned.  A transition targeting a junction is
+// only allowed if the guards of one of the junction's branches allow it.
+func (hsm *Base) selectTransition(state *StateInstance, event Event,
+	param interface{}) ([]*Transition, error) {
+	return hsm.selectSegments(state, event, param, 0)
+}
 
-	exitActions := []ActionFunc{}
-	entryActions := []ActionFunc{}
+// selectSegments implements selectTransition, where depth is the number of
+// junctions already chained.
+func (hsm *Base) selectSegments(state *StateInstance, event Event,
+	param interface{}, depth int) ([]*Transition, error) {
 
-	// If this is a self transition
-	if sourceState == targetState {
-		exitActions = sourceState.exitActions
-		entryActions = sourceState.entryActions
-		return exitActions, entryActions, nil
+	if depth > len(hsm.states) {
+		err := fmt.Errorf("junction %s in %s is part of a cycle",
+			state.Name, hsm.Name)
+		hsm.log.Error(err)
+		return nil, err
 	}
 
-	// Look for least common ancestor (LCA) state
-	for sourceParent := sourceState; lca == nil; {
-		for targetParent := targetState; targetParent != nil; {
-			if targetParent == sourceParent {
-				lca = targetParent
+	var elseTran *Transition
+	for _, tran := range state.transitions[event] {
+		if tran.Else {
+			if elseTran == nil {
+				elseTran = tran
+			}
+			continue
+		}
+		tranAllowed := true
+		for _, guard := range tran.guards() {
+			var err error
+			tranAllowed, err = hsm.evalGuard(state, event, tran, guard, param)
+			if err != nil {
+				return nil, err
+			}
+			if !tranAllowed {
 				break
 			}
-			targetParent = targetParent.parent
 		}
-		if lca != nil {
-			break
+		if !tranAllowed {
+			continue
+		}
+		segments, err := hsm.junctionSegments(tran, param, depth)
+		if segments != nil || err != nil {
+			return segments, err
 		}
-		// Add exit actions while looking for the LCA
-		exitActions = append(exitActions, sourceParent.exitActions...)
-		sourceParent = sourceParent.parent
 	}
+	if elseTran == nil {
+		return nil, nil
+	}
+	return hsm.junctionSegments(elseTran, param, depth)
+}
+
+// evalGuard evaluates a guard, a GuardFunc or ContextGuardFunc, of a
+// state's transition.
+func (hsm *Base) evalGuard(state *StateInstance, event Event,
+	tran *Transition, guard interface{}, param interface{}) (bool, error) {
+
+	var allowed bool
+	var err error
+	start := hsm.now()
+	switch fn := guard.(type) {
+	case GuardFunc:
+		allowed, err = fn(param)
+	case ContextGuardFunc:
+		allowed, err = fn(hsm.context(), param)
+	}
+	hsm.notify(Observation{Kind: GuardEvaluated, Event: event,
+		Source: state.Name, Target: tran.NewState, State: state.Name,
+		Action: funcName(guard), Param: param, Allowed: allowed,
+		Err: err}, start)
+	if err != nil {
+		hsm.logAction("guard function failed", tran, guard, param)
+	} else if !allowed {
+		hsm.logAction("transition guarded", tran, guard, param)
+	}
+	return allowed, err
+}
 
-	// Add entry actions for states up to by not including the LCA state.
-	for targetParent := targetState; targetParent != lca; {
-		entryActions = append(targetParent.entryActions, entryActions...)
-		targetParent = targetParent.parent
+// junctionSegments statically chains a transition through the junction,
+// entry point or exit point pseudostate it targets, if any, selecting the
+// pseudostate's first branch allowed by its guard.  The transition segments
+// are returned, or nil if the pseudostate has no branch allowed.
+func (hsm *Base) junctionSegments(tran *Transition, param interface{},
+	depth int) ([]*Transition, error) {
+
+	junction, ok := hsm.states[tran.NewState]
+	if !ok || !junction.isConnection() {
+		return []*Transition{tran}, nil
+	}
+	branches, err := hsm.selectSegments(junction, "", param, depth+1)
+	if branches == nil || err != nil {
+		return nil, err
 	}
+	return append([]*Transition{tran}, branches...), nil
+}
 
-	return exitActions, entryActions, err
+// leastCommonAncestor finds the transition domain: the least common ancestor
+// (LCA) of the source and target states.  States below the domain are exited
+// and entered by the transition.  The LCA may be the source or target state
+// itself, except for a self transition, which exits and re-enters the state.
+// An orthogonal state is never the domain, as its regions are always active
+// together; the domain moves up to its parent, so a transition between
+// regions exits and re-enters the orthogonal state with all its regions.
+// A nil domain is above the top state.
+func (hsm *Base) leastCommonAncestor(sourceState *StateInstance,
+	targetState *StateInstance) *StateInstance {
+
+	// If this is a self transition
+	domain := sourceState.parent
+	if sourceState != targetState {
+		// Look for least common ancestor (LCA) state
+		domain = sourceState
+		for domain != nil && !domain.contains(targetState) {
+			domain = domain.parent
+		}
+	}
+	for domain != nil && domain.parallel {
+		domain = domain.parent
+	}
+	return domain
 }
 
 // Apply transition to state machine
-func (hsm *Base) applyTransition(tran *Transition, exitActions []ActionFunc,
+func (hsm *Base) applyTransition(segments []*Transition, param interface{},
+	sourceState *StateInstance) error {
+
+	start := hsm.now()
+	tx := hsm.newTransaction(hsm.failurePolicy, sourceState,
+		segments[len(segments)-1])
+	tx.err.Event = segments[0].On
+	err := hsm.takeTransition(tx, segments, param, sourceState)
+	// The target of a transition through a choice is the state its
+	// selected branch enters.
+	target := segments[len(segments)-1].NewState
+	if tx.target != nil {
+		target = tx.target.Name
+	}
+	hsm.notify(Observation{Kind: TransitionCompleted, Event: segments[0].On,
+		Source: sourceState.Name, Target: target, State: hsm.CurrentState,
+		Param: param, Err: err}, start)
+	return err
+}
+
+// takeTransition runs the transition within the transaction, recovering
+// from failed actions according to the failure policy.
+func (hsm *Base) takeTransition(tx *transaction, segments []*Transition,
 	param interface{}, sourceState *StateInstance) error {
 
+	tran := segments[0]
+
 	// If internal transition, only execute the transition action and return.
 	if tran.NewState == "" {
-		var err error
-		if tran.Action != nil {
-			err = tran.Action(param)
-			hsm.logAction("internal/", tran, tran.Action, param)
+		for _, action := range tran.actions() {
+			err := hsm.runAction(tx, TransitionPhase, sourceState, tran,
+				action, param)
+			if err != nil {
+				return hsm.recover(tx, param, err)
+			}
 		}
+		return tx.result()
+	}
+
+	from := hsm.CurrentState
+	target := segments[len(segments)-1].NewState
+	targetState, err := hsm.lookupState(target)
+	if err != nil {
+		hsm.logAction("transition failed", tran, tran.Action, param)
 		return err
 	}
+	domain := hsm.leastCommonAncestor(sourceState, targetState)
+	err = hsm.runTransition(tx, segments, param, domain, sourceState,
+		targetState)
+	if err != nil {
+		return hsm.recover(tx, param, err)
+	}
+
+	// Log transition
+	hsm.log.WithFields(Fields{
+		"<state": from,
+		">state": hsm.CurrentState,
+		"on":     tran.On,
+	}).Debug("set state")
+	return tx.result()
+}
 
-	targetState, _ := hsm.lookupState(tran.NewState)
-	defaultStateName := targetState.initialState
-	finalStateName := targetState.Name
-	entryActions := []ActionFunc{}
+// runTransition runs the exit actions, the segment transition actions and
+// the entry actions of a transition from the source state to the target
+// state within the domain, then sets the new active configuration.  The
+// branches of a choice target are evaluated once its exit and transition
+// actions have run, and the selected branch continues the transition from
+// the same domain.  As in UML, the branch of an entry point runs once its
+// composite state is entered, after the composite's entry actions.
+func (hsm *Base) runTransition(tx *transaction, segments []*Transition,
+	param interface{}, domain *StateInstance, sourceState *StateInstance,
+	targetState *StateInstance) error {
+
+	// Collect the states exited and entered by the transition.  Exits run
+	// from the innermost states outward and entries from the outermost
+	// states inward, with orthogonal regions taken in document order.
+	exitSet := hsm.exitSet(domain)
+	entrySet := []*StateInstance{}
+	if targetState.kind != choiceState {
+		entrySet = hsm.entrySet(domain, targetState, exitSet)
+	}
 
-	// Get entry and/or exit actions required for the transition.
-	if sourceState.parent != nil && hsm.runState != OFF {
-		// Not in top state so use LCA to collect exit/entry actions
-		exitActionsFromSourceState, lcaEntryActions, err :=
-			hsm.leastCommonAncestor(sourceState, targetState)
+	// Run exit actions
+	tran := segments[0]
+	for _, state := range exitSet {
+		tx.exited = append(tx.exited, state)
+		hsm.suspendSubmachine(tx, state)
+		err := hsm.runStateActions(tx, ExitPhase, state, tran,
+			state.exitActionList(), state.exitCompensations, param)
 		if err != nil {
-			hsm.logAction("transition failed", tran, tran.Action, param)
-			hsm.log.Error(err)
 			return err
 		}
-		// Append exit actions from target state through the source state up to,
-		// but not including the least common ancestor (LCA) state.
-		exitActions = append(exitActions, exitActionsFromSourceState...)
-		entryActions = lcaEntryActions
-	} else {
-		// In Top state
-		// Handle the default entry actions, starting from top state.
-		defaultStateName = sourceState.initialState
 	}
 
-	// Add entry actions associated with default transitons
-	if hsm.runState != EXITING {
-		for defaultStateName != "" {
-			defaultState, err := hsm.lookupState(defaultStateName)
-			if err != nil {
-				return err
-			}
-			entryActions = append(entryActions, defaultState.entryActions...)
-			finalStateName = defaultStateName
-			defaultStateName = defaultState.initialState
-		}
+	// Run the transition actions up to the first entry point of a state
+	// to enter.
+	segments, sourceState, err := hsm.runSegments(tx, segments, param,
+		sourceState, entrySet)
+	if err != nil {
+		return err
 	}
 
-	// Run exit actions
-	for _, action := range exitActions {
-		err := action(param)
-		hsm.logAction("exit/    ", tran, action, param)
-		if err != nil {
-			return err
-		}
+	if targetState.kind == choiceState {
+		hsm.commitConfiguration(exitSet, entrySet)
+		return hsm.runChoice(tx, targetState, param, domain)
 	}
 
-	// Run the transition action
-	if tran.Action != nil {
-		err := tran.Action(param)
-		hsm.logAction("tran/    ", tran, tran.Action, param)
+	// Run entry actions, then the branches of the entry points of the
+	// state entered.
+	tx.target = targetState
+	for i, state := range entrySet {
+		tx.entered = append(tx.entered, state)
+		err := hsm.runStateActions(tx, EntryPhase, state, tran,
+			state.entryActionList(), state.entryCompensations, param)
 		if err != nil {
 			return err
 		}
-	}
-
-	// Run entry actions
-	for _, action := range entryActions {
-		err := action(param)
-		hsm.logAction("entry/   ", tran, action, param)
+		hsm.startSubmachine(state)
+		segments, sourceState, err = hsm.runSegments(tx, segments, param,
+			sourceState, entrySet[i+1:])
 		if err != nil {
 			return err
 		}
 	}
 
 	// Set New state
-	from := hsm.CurrentState
-	hsm.CurrentState = finalStateName
-	// Log transition
-	hsm.log.WithFields(logrus.Fields{
-		"<state": from,
-		">state": finalStateName,
-		"on":     tran.On,
-	}).Debug("set state")
+	hsm.commitConfiguration(exitSet, entrySet)
+	hsm.queueCompletions(entrySet)
 	return nil
 }
 
+// runSegments runs the transition actions of the segments of a compound
+// transition, each from the junction or connection point ending the
+// previous one, starting from the source state.  It stops at the first
+// entry point whose composite state is yet to be entered, returning the
+// segments left and their source state.
+func (hsm *Base) runSegments(tx *transaction, segments []*Transition,
+	param interface{}, sourceState *StateInstance,
+	unentered []*StateInstance) ([]*Transition, *StateInstance, error) {
+
+	n := hsm.readySegments(segments, sourceState, unentered)
+	for _, tran := range segments[:n] {
+		for i, action := range tran.actions() {
+			err := hsm.runAction(tx, TransitionPhase, sourceState, tran,
+				action, param)
+			if err != nil {
+				return nil, nil, err
+			}
+			if i == 0 && tran.Action != nil && tran.Compensation != nil {
+				tx.undo = append(tx.undo, []ActionFunc{tran.Compensation})
+			}
+		}
+		sourceState = hsm.states[tran.NewState]
+	}
+	return segments[n:], sourceState, nil
+}
+
+// readySegments returns how many segments, from the source state, run
+// before the unentered states are entered: those up to the first entry
+// point of one of the states.
+func (hsm *Base) readySegments(segments []*Transition,
+	sourceState *StateInstance, unentered []*StateInstance) int {
+
+	for n, tran := range segments {
+		if sourceState.kind == entryPointState &&
+			containsState(unentered, sourceState.parent) {
+			return n
+		}
+		sourceState = hsm.states[tran.NewState]
+	}
+	return len(segments)
+}
+
+// commitConfiguration records the history of the exited states, cancels
+// their time events, sets the new active configuration and arms the time
+// events of the entered states.
+func (hsm *Base) commitConfiguration(exitSet []*StateInstance,
+	entrySet []*StateInstance) {
+
+	hsm.recordHistory(exitSet)
+	for _, state := range exitSet {
+		hsm.cancelTimers(state)
+	}
+	hsm.setConfiguration(exitSet, entrySet)
+	for _, state := range entrySet {
+		hsm.armTimers(state)
+	}
+}
+
+// runChoice selects the branch of a choice pseudostate allowed by its guard
+// and continues the transition to the branch target.  The domain widens to
+// the least common ancestor of the domain and the branch target if the
+// target is outside the domain.  It is an error for a choice to have no
+// branch allowed.
+func (hsm *Base) runChoice(tx *transaction, choice *StateInstance,
+	param interface{}, domain *StateInstance) error {
+
+	segments, err := hsm.selectTransition(choice, "", param)
+	if err != nil {
+		return err
+	}
+	if segments == nil {
+		err = fmt.Errorf("no branch allowed for choice %s in %s",
+			choice.Name, hsm.Name)
+		hsm.log.Error(err)
+		return err
+	}
+	targetState, err := hsm.lookupState(segments[len(segments)-1].NewState)
+	if err != nil {
+		return err
+	}
+	if domain != nil && !domain.contains(targetState) {
+		domain = hsm.leastCommonAncestor(domain, targetState)
+	}
+	return hsm.runTransition(tx, segments, param, domain, choice,
+		targetState)
+}
+
 func (hsm *Base) logAction(actionType string, tran *Transition, fn interface{}, param interface{}) {
-	// TODO:  strip full path off name, as it is noisy and not needed.
-	fnName := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
-	hsm.log.WithFields(logrus.Fields{
+	hsm.log.WithFields(Fields{
 		"<state": hsm.CurrentState,
 		">state": tran.NewState,
 		"on":     tran.On,
-		"action": fnName,
+		"action": funcName(fn),
 		"param":  param,
 	}).Debug(actionType)
 }
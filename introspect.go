@@ -0,0 +1,125 @@
+package hsm
+
+import (
+	"sort"
+)
+
+// RunLevel is the run level of a machine: INITIALIZING, FINALIZED, ON,
+// EXITING or OFF.
+type RunLevel = hsmConfigState
+
+func (level hsmConfigState) String() string {
+	return runLevelNames[level]
+}
+
+// RunLevel returns the run level of the machine.  Like the other queries
+// of the active configuration, IsIn, ActivePath, HandledEvents and
+// Submachine, it waits for the event being dispatched, if any, to run to
+// completion, so it must not be called from actions or guards, which would
+// deadlock.
+func (hsm *Base) RunLevel() RunLevel {
+	hsm.Lock()
+	defer hsm.Unlock()
+	return hsm.runState
+}
+
+// IsIn returns true if the state is active, either as an active leaf state
+// or as the ancestor of one.
+func (hsm *Base) IsIn(name State) bool {
+	hsm.Lock()
+	defer hsm.Unlock()
+	state, ok := hsm.states[name]
+	return ok && state != hsm.topState && hsm.isActive(state)
+}
+
+// ActivePath returns the active states from the top state down to the
+// active leaf state.  With orthogonal regions active, the states of every
+// active region are returned, in document order.
+func (hsm *Base) ActivePath() []State {
+	hsm.Lock()
+	defer hsm.Unlock()
+	path := []State{}
+	for _, state := range hsm.activeStates() {
+		if state != hsm.topState {
+			path = append(path, state.Name)
+		}
+	}
+	return path
+}
+
+// Parent returns the parent of a state, or an empty state for the top
+// state.
+func (hsm *Base) Parent(name State) (State, error) {
+	state, err := hsm.lookupState(name)
+	if err != nil {
+		return "", err
+	}
+	if state.parent == nil || state.parent == hsm.topState {
+		return "", nil
+	}
+	return state.parent.Name, nil
+}
+
+// Children returns the children of a state, in the order they were added.
+func (hsm *Base) Children(name State) ([]State, error) {
+	state, err := hsm.lookupState(name)
+	if err != nil {
+		return nil, err
+	}
+	children := make([]State, 0, len(state.children))
+	for _, child := range state.children {
+		children = append(children, child.Name)
+	}
+	return children, nil
+}
+
+// InitialChild returns the default child of a composite state, or an empty
+// state for a leaf state or an orthogonal state, whose regions are all
+// entered.
+func (hsm *Base) InitialChild(name State) (State, error) {
+	state, err := hsm.lookupState(name)
+	if err != nil {
+		return "", err
+	}
+	if state.parallel {
+		return "", nil
+	}
+	return state.initialState, nil
+}
+
+// HandledEvents returns the events the active states, or their ancestors,
+// have transitions for, sorted by name.  Guards are not evaluated, so an
+// event may still be rejected; completion and time events, which cannot be
+// injected, are not included.
+func (hsm *Base) HandledEvents() []Event {
+	hsm.Lock()
+	defer hsm.Unlock()
+	events := []Event{}
+	for _, state := range hsm.activeStates() {
+		for event, trans := range state.transitions {
+			if event == "" || event == hsmInitEvent ||
+				event == hsmExitEvent || len(trans) == 0 {
+				continue
+			}
+			if _, _, ok := parseTimeEvent(event); ok {
+				continue
+			}
+			if !containsEvent(events, event) {
+				events = append(events, event)
+			}
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i] < events[j]
+	})
+	return events
+}
+
+func containsEvent(events []Event, event Event) bool {
+	for _, e := range events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package hsm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIntrospection(t *testing.T) {
+
+	Convey("CASE: Introspection", t, func() {
+		tr := &trace{}
+		sm := newRegionsHSM(tr)
+		So(sm.RunLevel(), ShouldEqual, hsm.FINALIZED)
+		sm.On()
+		sm.Inject(evStart, nil)
+
+		Convey("1. IsIn is true for active states and their ancestors\n", func() {
+			So(sm.RunLevel(), ShouldEqual, hsm.ON)
+			So(sm.IsIn(stMotorOff), ShouldBeTrue)
+			So(sm.IsIn(stRunning), ShouldBeTrue)
+			So(sm.IsIn(stTop), ShouldBeTrue)
+			So(sm.IsIn(stIdle), ShouldBeFalse)
+			So(sm.IsIn("unknown"), ShouldBeFalse)
+		})
+
+		Convey("2. The active path runs from the top state to the leaves\n", func() {
+			So(sm.ActivePath(), ShouldResemble, []hsm.State{stTop, stRunning,
+				stMotor, stMotorOff, stLamp, stLampOff})
+		})
+
+		Convey("3. The hierarchy of a state can be queried\n", func() {
+			parent, err := sm.Parent(stMotor)
+			So(err, ShouldBeNil)
+			So(parent, ShouldEqual, stRunning)
+			parent, _ = sm.Parent(stTop)
+			So(parent, ShouldBeEmpty)
+			children, _ := sm.Children(stTop)
+			So(children, ShouldResemble, []hsm.State{stIdle, stRunning})
+			initial, _ := sm.InitialChild(stLamp)
+			So(initial, ShouldEqual, stLampOff)
+			_, err = sm.InitialChild("unknown")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("4. Handled events are those of the active states\n", func() {
+			So(sm.HandledEvents(), ShouldResemble,
+				[]hsm.Event{evStop, evToggle})
+		})
+
+		Convey("5. Time events are not listed as handled events\n", func() {
+			polls := 0
+			timers := newTimersHSM(hsm.NewFakeClock(time.Unix(0, 0)), &polls)
+			timers.On()
+			So(timers.HandledEvents(), ShouldResemble, []hsm.Event{evPoll})
+		})
+	})
+}
@@ -0,0 +1,241 @@
+package hsm
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// JournalEntry records an event dispatched by a machine.  Param is encoded
+// by the machine's param codec, see SetParamCodec.  State is the state that
+// armed a time event.
+type JournalEntry struct {
+	Seq   uint64    `json:"seq"`
+	Time  time.Time `json:"time"`
+	Event Event     `json:"event"`
+	Param []byte    `json:"param"`
+	State State     `json:"state,omitempty"`
+}
+
+// Journal is an append-only log of journal entries.
+type Journal interface {
+	Append(entry JournalEntry) error
+	Entries() ([]JournalEntry, error)
+}
+
+// MemoryJournal keeps journal entries in memory.  It is safe for
+// concurrent use.
+type MemoryJournal struct {
+	entries []JournalEntry
+	sync.Mutex
+}
+
+// NewMemoryJournal creates an empty memory journal.
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{}
+}
+
+// Append adds the entry to the journal.
+func (journal *MemoryJournal) Append(entry JournalEntry) error {
+	journal.Lock()
+	defer journal.Unlock()
+	journal.entries = append(journal.entries, entry)
+	return nil
+}
+
+// Entries returns the journal entries in the order they were appended.
+func (journal *MemoryJournal) Entries() ([]JournalEntry, error) {
+	journal.Lock()
+	defer journal.Unlock()
+	return append([]JournalEntry{}, journal.entries...), nil
+}
+
+// FileJournal appends journal entries to a file, one JSON document per
+// line.
+type FileJournal struct {
+	path string
+	sync.Mutex
+}
+
+// NewFileJournal creates a journal appending to the file, which is created
+// if it does not exist.
+func NewFileJournal(path string) *FileJournal {
+	return &FileJournal{path: path}
+}
+
+// Append writes the entry at the end of the file.
+func (journal *FileJournal) Append(entry JournalEntry) error {
+	journal.Lock()
+	defer journal.Unlock()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(journal.path,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Entries reads the journal entries from the file.
+func (journal *FileJournal) Entries() ([]JournalEntry, error) {
+	journal.Lock()
+	defer journal.Unlock()
+	file, err := os.Open(journal.path)
+	if os.IsNotExist(err) {
+		return []JournalEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []JournalEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<24)
+	for scanner.Scan() {
+		entry := JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("cannot read journal %s: %v",
+				journal.path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// SetJournal records every event dispatched by the machine in the journal:
+// injected and posted events, time events, and the events turning the
+// machine on and off.  Events a state defers are recorded once, when first
+// dispatched.  An injected event that cannot be recorded is not
+// dispatched.
+func (hsm *Base) SetJournal(journal Journal) {
+	hsm.journal = journal
+}
+
+// record appends the event to the journal, if any.  The caller must hold
+// the RTC lock.
+func (hsm *Base) record(event Event, param interface{}) error {
+	return hsm.recordEntry(JournalEntry{Event: event}, param)
+}
+
+// recordTimeEvent appends the time event armed by the state to the journal,
+// if any.  The caller must hold the RTC lock.
+func (hsm *Base) recordTimeEvent(state *StateInstance, event Event) error {
+	return hsm.recordEntry(JournalEntry{Event: event, State: state.Name}, nil)
+}
+
+func (hsm *Base) recordEntry(entry JournalEntry, param interface{}) error {
+	if hsm.journal == nil || hsm.replaying {
+		return nil
+	}
+	event := entry.Event
+	data, err := hsm.paramCodec().Encode(event, param)
+	if err == nil {
+		hsm.journalSeq++
+		entry.Seq = hsm.journalSeq
+		entry.Time = hsm.clock.Now()
+		entry.Param = data
+		err = hsm.journal.Append(entry)
+	}
+	if err != nil {
+		err = fmt.Errorf("cannot record event %s in journal of hsm %s: %v",
+			event, hsm.Name, err)
+		hsm.log.Error(err)
+	}
+	return err
+}
+
+// Replay rebuilds the machine by dispatching the journal entries, in
+// order, through the same path as Inject.  The machine must be built with
+// the same states as the machine that recorded the journal and must not be
+// on; the journal's events turn it on.  Events posted while replaying are
+// discarded, as the journal records them, and time events are dispatched
+// to the state that armed them, as when their timer fired.  No timer is
+// armed and no checkpoint is saved while replaying; the time events of the
+// states active once replayed are armed from the end of the replay.  If
+// suppressActions is true, entry, exit and transition actions are not run;
+// guards still are.  Events that fail while replaying, as they did when
+// recorded, are logged.  Events journaled once replayed are numbered after
+// the last entry of the journal.  An error is returned if an entry cannot
+// be decoded.
+func (hsm *Base) Replay(journal Journal, suppressActions bool) error {
+	entries, err := journal.Entries()
+	if err != nil {
+		return err
+	}
+
+	hsm.Lock()
+	defer hsm.Unlock()
+	if hsm.runState != FINALIZED && hsm.runState != OFF {
+		err := fmt.Errorf("cannot replay hsm %s; it is on or not finalized",
+			hsm.Name)
+		hsm.log.Error(err)
+		return err
+	}
+	if len(entries) > 0 {
+		hsm.journalSeq = entries[len(entries)-1].Seq
+	}
+	hsm.replaying = true
+	hsm.suppressActions = suppressActions
+	defer func() {
+		hsm.replaying = false
+		hsm.suppressActions = false
+		if hsm.runState == ON {
+			for _, state := range hsm.activeStates() {
+				hsm.armTimers(state)
+			}
+		}
+	}()
+
+	for _, entry := range entries {
+		param, err := hsm.paramCodec().Decode(entry.Event, entry.Param)
+		if err != nil {
+			return fmt.Errorf("cannot decode param of journal entry %d: %v",
+				entry.Seq, err)
+		}
+		switch entry.Event {
+		case hsmInitEvent:
+			if hsm.runState == FINALIZED || hsm.runState == OFF {
+				hsm.runState = ON
+			}
+		case hsmExitEvent:
+			if hsm.runState == ON {
+				hsm.runState = EXITING
+			}
+		}
+		if entry.State != "" {
+			var state *StateInstance
+			state, err = hsm.lookupState(entry.State)
+			if err == nil {
+				_, err = hsm.dispatchTimeEvent(state, entry.Event)
+			}
+		} else {
+			err = hsm.dispatch(entry.Event, param)
+		}
+		if err != nil {
+			hsm.log.WithFields(Fields{
+				"on":  entry.Event,
+				"seq": entry.Seq,
+			}).Error("replayed event failed: ", err)
+		}
+		hsm.dispatchDeferred()
+		if hsm.runState == EXITING {
+			hsm.runState = OFF
+			hsm.clearQueue()
+		}
+		hsm.queueLock.Lock()
+		hsm.queue = nil
+		hsm.queueLock.Unlock()
+	}
+	return nil
+}
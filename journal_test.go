@@ -0,0 +1,151 @@
+package hsm_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	stZone     hsm.State = "zone"
+	stWatching hsm.State = "watching"
+	stSounding hsm.State = "sounding"
+)
+
+// newZoneHSM builds a zone that sounds 5s after it is entered, while its
+// watching state only logs a timeout after the same 5s.
+func newZoneHSM(tr *trace, clock hsm.Clock) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("zoneHSM")
+	sm.SetClock(clock)
+
+	zone := sm.NewState(stZone)
+	zone.AddTransitions([]hsm.Transition{
+		{On: hsm.After(5 * time.Second), NewState: stSounding}})
+	watching := sm.NewState(stWatching)
+	watching.AddTransitions([]hsm.Transition{
+		{On: hsm.After(5 * time.Second), Action: tr.action("timeout")}})
+	sounding := sm.NewState(stSounding)
+
+	top := sm.NewState("alarm")
+	top.AddChildren(zone, sounding)
+	zone.AddChildren(watching)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestJournal(t *testing.T) {
+
+	Convey("CASE: Event Journal and Replay", t, func() {
+		journal := hsm.NewMemoryJournal()
+		sm := newQueueHSM(&trace{}, make(chan hsm.State, 1))
+		sm.SetJournal(journal)
+		sm.On()
+		sm.Inject(evBegin, "job")
+
+		Convey("1. Dispatched events are journaled in order\n", func() {
+			entries, err := journal.Entries()
+			So(err, ShouldBeNil)
+			events := []hsm.Event{}
+			for _, entry := range entries {
+				events = append(events, entry.Event)
+			}
+			So(events, ShouldResemble, []hsm.Event{
+				"InitialTransition", evBegin, evWorkDone})
+			So(string(entries[1].Param), ShouldEqual, `"job"`)
+		})
+
+		Convey("2. Replay rebuilds the machine, running actions once\n", func() {
+			tr := &trace{}
+			replayed := newQueueHSM(tr, make(chan hsm.State, 1))
+			So(replayed.Replay(journal, false), ShouldBeNil)
+			So(replayed.CurrentState, ShouldEqual, stComplete)
+			So(*tr, ShouldResemble, trace{"working entry", "working exit"})
+		})
+
+		Convey("3. Replay can suppress actions\n", func() {
+			tr := &trace{}
+			replayed := newQueueHSM(tr, make(chan hsm.State))
+			done := make(chan error, 1)
+			go func() { done <- replayed.Replay(journal, true) }()
+			err := errors.New("replay blocked running a suppressed action")
+			select {
+			case err = <-done:
+			case <-time.After(time.Second):
+			}
+			So(err, ShouldBeNil)
+			So(replayed.CurrentState, ShouldEqual, stComplete)
+			So(*tr, ShouldBeEmpty)
+		})
+
+		Convey("4. The file journal appends entries to its file\n", func() {
+			dir, err := ioutil.TempDir("", "hsm")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			file := hsm.NewFileJournal(filepath.Join(dir, "journal"))
+			entries, _ := journal.Entries()
+			for _, entry := range entries {
+				So(file.Append(entry), ShouldBeNil)
+			}
+			read, err := file.Entries()
+			So(err, ShouldBeNil)
+			So(read, ShouldHaveLength, 3)
+			So(read[1].Event, ShouldEqual, evBegin)
+		})
+
+		Convey("5. Time events are replayed by the state that armed them\n", func() {
+			tr := &trace{}
+			clock := hsm.NewFakeClock(time.Unix(0, 0))
+			zoneJournal := hsm.NewMemoryJournal()
+			zone := newZoneHSM(tr, clock)
+			zone.SetJournal(zoneJournal)
+			zone.On()
+			clock.Advance(5 * time.Second)
+			So(zone.CurrentState, ShouldEqual, stSounding)
+			entries, _ := zoneJournal.Entries()
+			So(entries[1].State, ShouldEqual, stZone)
+
+			store := &countingStore{MemoryStore: hsm.NewMemoryStore()}
+			replayed := newZoneHSM(tr, clock)
+			replayed.EnableCheckpoints(store, "zone-1")
+			So(replayed.Replay(zoneJournal, false), ShouldBeNil)
+			So(replayed.CurrentState, ShouldEqual, stSounding)
+			So(*tr, ShouldBeEmpty)
+			So(store.saves, ShouldEqual, 0)
+		})
+
+		Convey("6. Timers are armed once the replay ends\n", func() {
+			clock := hsm.NewFakeClock(time.Unix(0, 0))
+			zoneJournal := hsm.NewMemoryJournal()
+			zone := newZoneHSM(&trace{}, clock)
+			zone.SetJournal(zoneJournal)
+			zone.On()
+
+			replayed := newZoneHSM(&trace{}, clock)
+			So(replayed.Replay(zoneJournal, false), ShouldBeNil)
+			So(replayed.CurrentState, ShouldEqual, stWatching)
+			clock.Advance(5 * time.Second)
+			So(replayed.CurrentState, ShouldEqual, stSounding)
+		})
+
+		Convey("7. Events journaled once replayed continue the sequence\n", func() {
+			replayed := newQueueHSM(&trace{}, make(chan hsm.State, 1))
+			So(replayed.Replay(journal, false), ShouldBeNil)
+			replayed.SetJournal(journal)
+			replayed.Inject(evBegin, nil)
+			entries, err := journal.Entries()
+			So(err, ShouldBeNil)
+			So(entries, ShouldHaveLength, 4)
+			for i := 1; i < len(entries); i++ {
+				So(entries[i].Seq, ShouldBeGreaterThan, entries[i-1].Seq)
+			}
+		})
+	})
+}
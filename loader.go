@@ -0,0 +1,203 @@
+package hsm
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Chart describes a state machine in a YAML or JSON document.  Actions and
+// guards are referenced by name and bound to functions through a Registry
+// when the chart is loaded.
+type Chart struct {
+	Name string `json:"name" yaml:"name"`
+	// Top is the top state of the machine, holding every other state.
+	Top ChartState `json:"top" yaml:"top"`
+}
+
+// ChartState describes a state and its children.  Kind is one of "state"
+// (the default), "parallel", "shallowHistory", "deepHistory", "choice",
+// "junction", "entryPoint", "exitPoint" or "final".  The first regular
+// child is the default state of a composite state; every child of a
+// parallel state is a region.
+type ChartState struct {
+	Name        State             `json:"name" yaml:"name"`
+	Kind        string            `json:"kind,omitempty" yaml:"kind,omitempty"`
+	Entry       []string          `json:"entry,omitempty" yaml:"entry,omitempty"`
+	Exit        []string          `json:"exit,omitempty" yaml:"exit,omitempty"`
+	Defer       []Event           `json:"defer,omitempty" yaml:"defer,omitempty"`
+	Transitions []ChartTransition `json:"transitions,omitempty" yaml:"transitions,omitempty"`
+	States      []ChartState      `json:"states,omitempty" yaml:"states,omitempty"`
+}
+
+// ChartTransition describes a transition.  An empty To makes an internal
+// transition; an empty On makes a completion transition or, for choice,
+// junction, entry point and exit point pseudostates, a branch.
+type ChartTransition struct {
+	On     Event  `json:"on,omitempty" yaml:"on,omitempty"`
+	To     State  `json:"to,omitempty" yaml:"to,omitempty"`
+	Action string `json:"action,omitempty" yaml:"action,omitempty"`
+	Guard  string `json:"guard,omitempty" yaml:"guard,omitempty"`
+	Else   bool   `json:"else,omitempty" yaml:"else,omitempty"`
+}
+
+// Registry binds the action and guard names used by charts to functions.
+type Registry struct {
+	actions map[string]ActionFunc
+	guards  map[string]GuardFunc
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		actions: make(map[string]ActionFunc),
+		guards:  make(map[string]GuardFunc),
+	}
+}
+
+// AddAction binds an action name to an action function.
+func (registry *Registry) AddAction(name string, action ActionFunc) {
+	registry.actions[name] = action
+}
+
+// AddGuard binds a guard name to a guard function.
+func (registry *Registry) AddGuard(name string, guard GuardFunc) {
+	registry.guards[name] = guard
+}
+
+func (registry *Registry) action(name string) (ActionFunc, error) {
+	if name == "" {
+		return nil, nil
+	}
+	action, ok := registry.actions[name]
+	if !ok {
+		return nil, fmt.Errorf("action %s is not registered", name)
+	}
+	return action, nil
+}
+
+func (registry *Registry) guard(name string) (GuardFunc, error) {
+	if name == "" {
+		return nil, nil
+	}
+	guard, ok := registry.guards[name]
+	if !ok {
+		return nil, fmt.Errorf("guard %s is not registered", name)
+	}
+	return guard, nil
+}
+
+// LoadYAML configures and finalizes the state machine from a YAML chart.
+func (hsm *Base) LoadYAML(data []byte, registry *Registry) error {
+	chart := &Chart{}
+	if err := yaml.UnmarshalStrict(data, chart); err != nil {
+		return fmt.Errorf("cannot load yaml chart: %v", err)
+	}
+	return hsm.LoadChart(chart, registry)
+}
+
+// LoadJSON configures and finalizes the state machine from a JSON chart.
+// Unknown keys are rejected, as they are for YAML charts.
+func (hsm *Base) LoadJSON(data []byte, registry *Registry) error {
+	chart := &Chart{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(chart); err != nil {
+		return fmt.Errorf("cannot load json chart: %v", err)
+	}
+	return hsm.LoadChart(chart, registry)
+}
+
+// LoadChart configures and finalizes the state machine from a chart,
+// binding its action and guard names through the registry.
+func (hsm *Base) LoadChart(chart *Chart, registry *Registry) error {
+	hsm.Configure(chart.Name)
+	if _, err := hsm.loadState(&chart.Top, registry); err != nil {
+		hsm.log.Error(err)
+		return err
+	}
+	return hsm.Finalize()
+}
+
+// loadState creates a chart state and, recursively, its children.
+func (hsm *Base) loadState(chartState *ChartState,
+	registry *Registry) (*StateInstance, error) {
+
+	var state *StateInstance
+	switch chartState.Kind {
+	case "", "state", "parallel":
+		state = hsm.NewState(chartState.Name)
+	case "shallowHistory":
+		state = hsm.NewShallowHistory(chartState.Name)
+	case "deepHistory":
+		state = hsm.NewDeepHistory(chartState.Name)
+	case "choice":
+		state = hsm.NewChoice(chartState.Name)
+	case "junction":
+		state = hsm.NewJunction(chartState.Name)
+	case "entryPoint":
+		state = hsm.NewEntryPoint(chartState.Name)
+	case "exitPoint":
+		state = hsm.NewExitPoint(chartState.Name)
+	case "final":
+		state = hsm.NewFinalState(chartState.Name)
+	default:
+		return nil, fmt.Errorf("state %s has unknown kind %s",
+			chartState.Name, chartState.Kind)
+	}
+	if state == nil {
+		return nil, fmt.Errorf("cannot add state %s to hsm %s",
+			chartState.Name, hsm.Name)
+	}
+
+	for _, name := range chartState.Entry {
+		action, err := registry.action(name)
+		if err != nil {
+			return nil, fmt.Errorf("entry of state %s: %v", state.Name, err)
+		}
+		state.AddEntryActions(action)
+	}
+	for _, name := range chartState.Exit {
+		action, err := registry.action(name)
+		if err != nil {
+			return nil, fmt.Errorf("exit of state %s: %v", state.Name, err)
+		}
+		state.AddExitActions(action)
+	}
+	state.AddDeferredEvents(chartState.Defer...)
+
+	trans := []Transition{}
+	for _, chartTran := range chartState.Transitions {
+		action, err := registry.action(chartTran.Action)
+		if err != nil {
+			return nil, fmt.Errorf("transition of state %s on %s: %v",
+				state.Name, chartTran.On, err)
+		}
+		guard, err := registry.guard(chartTran.Guard)
+		if err != nil {
+			return nil, fmt.Errorf("transition of state %s on %s: %v",
+				state.Name, chartTran.On, err)
+		}
+		trans = append(trans, Transition{On: chartTran.On,
+			NewState: chartTran.To, Action: action, Guard: guard,
+			Else: chartTran.Else})
+	}
+	state.AddTransitions(trans)
+
+	children := []*StateInstance{}
+	for i := range chartState.States {
+		child, err := hsm.loadState(&chartState.States[i], registry)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if chartState.Kind == "parallel" {
+		state.AddRegions(children...)
+	} else if len(children) > 0 {
+		state.AddChildren(children...)
+	}
+	return state, nil
+}
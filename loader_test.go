@@ -0,0 +1,98 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evPlay    hsm.Event = "play"
+	evPause   hsm.Event = "pause"
+	stPlayer  hsm.State = "player"
+	stStopped hsm.State = "stopped"
+	stPlaying hsm.State = "playing"
+	stPaused  hsm.State = "paused"
+)
+
+const (
+	playerYAML = `
+name: playerHSM
+top:
+  name: player
+  states:
+    - name: stopped
+      exit: [stoppedExit]
+      transitions:
+        - {on: play, to: playing, guard: loaded}
+    - name: playing
+      transitions:
+        - {on: pause, to: paused}
+    - name: paused
+      transitions:
+        - {on: play, to: playing}
+`
+	playerJSON = `{
+  "name": "playerHSM",
+  "top": {"name": "player", "states": [
+    {"name": "stopped", "exit": ["stoppedExit"],
+     "transitions": [{"on": "play", "to": "playing", "guard": "loaded"}]},
+    {"name": "playing", "transitions": [{"on": "pause", "to": "paused"}]},
+    {"name": "paused", "transitions": [{"on": "play", "to": "playing"}]}
+  ]}
+}`
+)
+
+func newPlayerRegistry(tr *trace) *hsm.Registry {
+	registry := hsm.NewRegistry()
+	registry.AddAction("stoppedExit", tr.exit(string(stStopped)))
+	registry.AddGuard("loaded", func(param interface{}) (bool, error) {
+		return param != nil, nil
+	})
+	return registry
+}
+
+func TestLoader(t *testing.T) {
+
+	Convey("CASE: Loading Charts", t, func() {
+		tr := &trace{}
+		registry := newPlayerRegistry(tr)
+
+		Convey("1. A YAML chart builds the machine\n", func() {
+			sm := &hsm.Base{}
+			So(sm.LoadYAML([]byte(playerYAML), registry), ShouldBeNil)
+			So(sm.On(), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stStopped)
+			So(sm.Inject(evPlay, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stStopped)
+			So(sm.Inject(evPlay, "track"), ShouldBeNil)
+			So(sm.Inject(evPause, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stPaused)
+			So(*tr, ShouldResemble, trace{"stopped exit"})
+		})
+
+		Convey("2. A JSON chart builds the same machine\n", func() {
+			sm := &hsm.Base{}
+			So(sm.LoadJSON([]byte(playerJSON), registry), ShouldBeNil)
+			So(sm.On(), ShouldBeNil)
+			So(sm.Inject(evPlay, "track"), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stPlaying)
+		})
+
+		Convey("3. Unregistered names fail the load\n", func() {
+			sm := &hsm.Base{}
+			err := sm.LoadYAML([]byte(playerYAML), hsm.NewRegistry())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("4. Unknown keys fail the load\n", func() {
+			sm := &hsm.Base{}
+			err := sm.LoadJSON([]byte(`{"name": "player", "tpo": {}}`),
+				registry)
+			So(err, ShouldNotBeNil)
+			err = sm.LoadYAML([]byte("name: player\ntpo: {}\n"), registry)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
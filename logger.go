@@ -0,0 +1,143 @@
+package hsm
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
+
+// Fields are the structured fields of a log entry.
+type Fields map[string]interface{}
+
+// Logger is the logging interface used by the state machine.  Transitions
+// are logged at debug level, and failures at error level.  Adapters are
+// provided for the standard log package, NewStdLogger, for log/slog style
+// structured loggers, NewStructuredLogger, and for logrus, in the
+// github.com/ckbaldy/hsm/logrusadapter module.
+type Logger interface {
+	// WithFields returns a logger adding the fields to every entry.
+	WithFields(fields Fields) Logger
+	Debug(args ...interface{})
+	Warn(args ...interface{})
+	Error(args ...interface{})
+}
+
+// LogLevel enumeration type that selects the entries written by the
+// standard log adapter.
+type LogLevel int
+
+// LogLevel enumeration
+const (
+	DebugLevel LogLevel = iota
+	WarnLevel
+	ErrorLevel
+)
+
+var logLevelNames = []string{"DEBUG", "WARN", "ERROR"}
+
+// nopLogger discards every entry.  It is the default logger.
+type nopLogger struct{}
+
+func (nopLogger) WithFields(fields Fields) Logger { return nopLogger{} }
+func (nopLogger) Debug(args ...interface{})       {}
+func (nopLogger) Warn(args ...interface{})        {}
+func (nopLogger) Error(args ...interface{})       {}
+
+// stdLogger adapts a standard library logger.
+type stdLogger struct {
+	logger *log.Logger
+	level  LogLevel
+	fields Fields
+}
+
+// NewStdLogger adapts a standard library logger, writing the entries at or
+// above the level as "LEVEL message key=value ...", fields sorted by key.
+func NewStdLogger(logger *log.Logger, level LogLevel) Logger {
+	return &stdLogger{logger: logger, level: level, fields: Fields{}}
+}
+
+func (l *stdLogger) WithFields(fields Fields) Logger {
+	return &stdLogger{logger: l.logger, level: l.level,
+		fields: mergeFields(l.fields, fields)}
+}
+
+func (l *stdLogger) Debug(args ...interface{}) { l.write(DebugLevel, args) }
+func (l *stdLogger) Warn(args ...interface{})  { l.write(WarnLevel, args) }
+func (l *stdLogger) Error(args ...interface{}) { l.write(ErrorLevel, args) }
+
+func (l *stdLogger) write(level LogLevel, args []interface{}) {
+	if level < l.level {
+		return
+	}
+	entry := []string{logLevelNames[level], fmt.Sprint(args...)}
+	for _, key := range sortedKeys(l.fields) {
+		entry = append(entry, fmt.Sprintf("%s=%v", key, l.fields[key]))
+	}
+	l.logger.Print(strings.Join(entry, " "))
+}
+
+// StructuredLogger is implemented by log/slog style loggers, such as
+// *slog.Logger, taking a message followed by alternating keys and values.
+type StructuredLogger interface {
+	Debug(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// structuredLogger adapts a log/slog style logger.
+type structuredLogger struct {
+	logger StructuredLogger
+	fields Fields
+}
+
+// NewStructuredLogger adapts a log/slog style structured logger, passing
+// fields as key/value pairs sorted by key.
+func NewStructuredLogger(logger StructuredLogger) Logger {
+	return &structuredLogger{logger: logger, fields: Fields{}}
+}
+
+func (l *structuredLogger) WithFields(fields Fields) Logger {
+	return &structuredLogger{logger: l.logger,
+		fields: mergeFields(l.fields, fields)}
+}
+
+func (l *structuredLogger) Debug(args ...interface{}) {
+	l.logger.Debug(fmt.Sprint(args...), l.args()...)
+}
+
+func (l *structuredLogger) Warn(args ...interface{}) {
+	l.logger.Warn(fmt.Sprint(args...), l.args()...)
+}
+
+func (l *structuredLogger) Error(args ...interface{}) {
+	l.logger.Error(fmt.Sprint(args...), l.args()...)
+}
+
+func (l *structuredLogger) args() []interface{} {
+	args := make([]interface{}, 0, 2*len(l.fields))
+	for _, key := range sortedKeys(l.fields) {
+		args = append(args, key, l.fields[key])
+	}
+	return args
+}
+
+func mergeFields(fields Fields, more Fields) Fields {
+	merged := make(Fields, len(fields)+len(more))
+	for key, value := range fields {
+		merged[key] = value
+	}
+	for key, value := range more {
+		merged[key] = value
+	}
+	return merged
+}
+
+func sortedKeys(fields Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
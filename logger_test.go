@@ -0,0 +1,61 @@
+package hsm_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// recorder is a log/slog style structured logger recording its entries.
+type recorder []string
+
+func (r *recorder) record(level string, msg string, args []interface{}) {
+	*r = append(*r, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (r *recorder) Debug(msg string, args ...interface{}) {
+	r.record("debug", msg, args)
+}
+
+func (r *recorder) Warn(msg string, args ...interface{}) {
+	r.record("warn", msg, args)
+}
+
+func (r *recorder) Error(msg string, args ...interface{}) {
+	r.record("error", msg, args)
+}
+
+func TestLoggers(t *testing.T) {
+
+	Convey("CASE: Pluggable Loggers", t, func() {
+		tr := &trace{}
+		sm := newPseudostatesHSM(tr)
+
+		Convey("1. The standard log adapter writes entries at its level\n", func() {
+			out := &bytes.Buffer{}
+			sm.AddLogger(hsm.NewStdLogger(log.New(out, "", 0), hsm.ErrorLevel))
+			sm.On()
+			So(sm.Inject("unknown", nil), ShouldNotBeNil)
+			So(out.String(), ShouldEqual, "ERROR unhandled event/transition "+
+				"on=unknown prefix=pseudostatesHSM state=ready\n")
+		})
+
+		Convey("2. The structured adapter passes fields as key/value pairs\n", func() {
+			rec := &recorder{}
+			sm.AddLogger(hsm.NewStructuredLogger(rec))
+			sm.On()
+			sm.Inject("unknown", nil)
+			So(*rec, ShouldContain, "error unhandled event/transition "+
+				"[on unknown prefix pseudostatesHSM state ready]")
+		})
+
+		Convey("3. Logging is disabled by default\n", func() {
+			sm.DisableLogger()
+			So(sm.On(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,10 @@
+module github.com/ckbaldy/hsm/logrusadapter
+
+go 1.13
+
+require (
+	github.com/ckbaldy/hsm v0.0.0
+	github.com/sirupsen/logrus v1.9.3
+)
+
+replace github.com/ckbaldy/hsm => ../
@@ -0,0 +1,25 @@
+// Package logrusadapter adapts logrus loggers to the hsm Logger interface.
+// It is a module of its own so that the hsm module does not depend on logrus.
+package logrusadapter
+
+import (
+	"github.com/ckbaldy/hsm"
+	"github.com/sirupsen/logrus"
+)
+
+// entry adapts a logrus entry.
+type entry struct {
+	*logrus.Entry
+}
+
+// New adapts a logrus logger, enabling logging of state machine
+// transitions with:
+//
+//	sm.AddLogger(logrusadapter.New(logger))
+func New(logger *logrus.Logger) hsm.Logger {
+	return entry{logrus.NewEntry(logger)}
+}
+
+func (e entry) WithFields(fields hsm.Fields) hsm.Logger {
+	return entry{e.Entry.WithFields(logrus.Fields(fields))}
+}
@@ -0,0 +1,96 @@
+package hsm
+
+import (
+	"time"
+)
+
+// ObservationKind enumeration type that identifies what a listener
+// observes.
+type ObservationKind int
+
+// ObservationKind enumeration
+const (
+	// EventReceived is observed when an event is dispatched.
+	EventReceived ObservationKind = iota
+	// EventUnhandled is observed when no state handles an event.
+	EventUnhandled
+	// GuardEvaluated is observed when a transition guard is evaluated.
+	GuardEvaluated
+	// StateExited is observed once the exit actions of a state have run.
+	StateExited
+	// ActionRun is observed once a transition action has run.
+	ActionRun
+	// StateEntered is observed once the entry actions of a state have run.
+	StateEntered
+	// TransitionCompleted is observed once a transition has been taken or
+	// has failed.
+	TransitionCompleted
+)
+
+var observationKindNames = []string{"EventReceived", "EventUnhandled",
+	"GuardEvaluated", "StateExited", "ActionRun", "StateEntered",
+	"TransitionCompleted"}
+
+func (kind ObservationKind) String() string {
+	return observationKindNames[kind]
+}
+
+// Observation records what a listener observes.  Source and Target are the
+// source and target states of the transition being taken, if any, and
+// State the state exited, entered or whose guard is evaluated.  Once a
+// transition through a choice is completed, Target is the state its
+// selected branch enters.  Time is
+// when the observed step started, on the machine clock, and Duration how
+// long it took.
+type Observation struct {
+	Kind     ObservationKind
+	Machine  string
+	Event    Event
+	Source   State
+	Target   State
+	State    State
+	Action   string
+	Param    interface{}
+	Allowed  bool
+	Time     time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// Listener is called with each observation.  Listeners are called while
+// the event runs to completion, so they must not call Inject; they may
+// call Post.
+type Listener func(observation Observation)
+
+// AddListener adds a listener observing the events, guards, states and
+// transitions of the machine.
+func (hsm *Base) AddListener(listener Listener) {
+	hsm.listeners = append(hsm.listeners, listener)
+}
+
+// notify calls the listeners with the observation, completing its machine
+// name and, if start is set, its time and duration.
+func (hsm *Base) notify(observation Observation, start time.Time) {
+	if len(hsm.listeners) == 0 {
+		return
+	}
+	observation.Machine = hsm.Name
+	if !start.IsZero() {
+		observation.Time = start
+		observation.Duration = hsm.clock.Now().Sub(start)
+	} else {
+		observation.Time = hsm.clock.Now()
+	}
+	for _, listener := range hsm.listeners {
+		listener(observation)
+	}
+}
+
+// now returns the machine time, for timing observations, if listeners are
+// added.
+func (hsm *Base) now() time.Time {
+	if len(hsm.listeners) == 0 {
+		return time.Time{}
+	}
+	return hsm.clock.Now()
+}
@@ -0,0 +1,69 @@
+package hsm_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestListeners(t *testing.T) {
+
+	Convey("CASE: Transition Listeners", t, func() {
+		tr := &trace{}
+		sm := newPseudostatesHSM(tr)
+		clock := hsm.NewFakeClock(time.Unix(0, 0))
+		sm.SetClock(clock)
+		sm.On()
+		observed := []string{}
+		observations := []hsm.Observation{}
+		sm.AddListener(func(observation hsm.Observation) {
+			observed = append(observed, fmt.Sprint(observation.Kind, " ",
+				observation.State))
+			observations = append(observations, observation)
+		})
+
+		Convey("1. Listeners observe every step of a transition\n", func() {
+			So(sm.Inject(evRoute, "b"), ShouldBeNil)
+			So(observed, ShouldResemble, []string{
+				"EventReceived ready",
+				"StateExited ready",
+				"ActionRun ready",
+				"GuardEvaluated choice",
+				"GuardEvaluated choice",
+				"StateEntered routeB",
+				"TransitionCompleted routeB",
+			})
+			last := observations[len(observations)-1]
+			So(last.Machine, ShouldEqual, "pseudostatesHSM")
+			So(last.Source, ShouldEqual, stReady)
+			So(last.Target, ShouldEqual, stRouteB)
+			So(observations[1].Target, ShouldEqual, stChoice)
+			So(last.Event, ShouldEqual, evRoute)
+			So(last.Param, ShouldEqual, "b")
+			So(last.Time, ShouldResemble, time.Unix(0, 0))
+		})
+
+		Convey("2. Guard observations report whether they allowed\n", func() {
+			sm.Inject(evRoute, "b")
+			So(observations[3].Allowed, ShouldBeFalse)
+			So(observations[4].Allowed, ShouldBeTrue)
+		})
+
+		Convey("3. Action observations report the source of their segment\n", func() {
+			So(sm.Inject(evJump, "a"), ShouldBeNil)
+			So(observed, ShouldContain, "ActionRun ready")
+			So(observed, ShouldContain, "ActionRun junction")
+			So(observed, ShouldNotContain, "ActionRun routeA")
+		})
+
+		Convey("4. Unhandled events are observed with their error\n", func() {
+			err := sm.Inject("unknown", nil)
+			So(observed, ShouldResemble, []string{
+				"EventReceived ready", "EventUnhandled ready"})
+			So(observations[1].Err, ShouldResemble, err)
+		})
+	})
+}
@@ -0,0 +1,225 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PreviewStep is a step of a previewed transition: a state exited or
+// entered, with its exit or entry actions, or the transition actions of a
+// transition from a state.
+type PreviewStep struct {
+	Phase   ActionPhase
+	State   State
+	Actions []string
+}
+
+// Preview describes what injecting an event would do.  Steps lists, in
+// order, the states exited, the transition actions run and the states
+// entered by the transitions taken, and Leaves the resulting active leaf
+// states.  Deferred is true if the event would be deferred.
+type Preview struct {
+	Event    Event
+	Steps    []PreviewStep
+	Leaves   []State
+	Deferred bool
+}
+
+// CanInject returns true if injecting the event would take a transition,
+// in the machine or in one of its running sub-machines.  Guards are
+// evaluated, with the param, but no action is run.
+func (hsm *Base) CanInject(event Event, param interface{}) (bool, error) {
+	hsm.Lock()
+	defer hsm.Unlock()
+	if hsm.runState != ON {
+		return false, nil
+	}
+	listeners := hsm.listeners
+	hsm.listeners = nil
+	defer func() { hsm.listeners = listeners }()
+
+	for _, leaf := range hsm.leaves {
+		if sub, ok := hsm.submachines[leaf]; ok {
+			if can, err := sub.CanInject(event, param); can || err != nil {
+				return can, err
+			}
+		}
+	}
+
+	enabled, _, err := hsm.enabledTransitions(event, param, nil)
+	return len(enabled) > 0, err
+}
+
+// Preview returns the steps that injecting the event would take, without
+// running any action.  Guards are evaluated, with the param, including the
+// guards of the choice pseudostates a transition would reach.  Completion
+// transitions that would follow are not included.  An error is returned if
+// the event would be unhandled, or handled or deferred by a running
+// sub-machine, whose states are not previewed.
+func (hsm *Base) Preview(event Event, param interface{}) (*Preview, error) {
+	hsm.Lock()
+	defer hsm.Unlock()
+	if hsm.runState != ON {
+		return nil, fmt.Errorf("cannot preview events of hsm %s; it is not on",
+			hsm.Name)
+	}
+	listeners := hsm.listeners
+	hsm.listeners = nil
+	defer func() { hsm.listeners = listeners }()
+
+	for _, leaf := range hsm.leaves {
+		sub, ok := hsm.submachines[leaf]
+		if !ok {
+			continue
+		}
+		_, err := sub.Preview(event, param)
+		if err == nil {
+			err = fmt.Errorf("cannot preview event %s of hsm %s; it is "+
+				"dispatched to the sub-machine of %s", event, hsm.Name,
+				leaf.Name)
+		}
+		if !errors.Is(err, ErrUnhandledEvent) {
+			return nil, err
+		}
+	}
+
+	preview := &Preview{Event: event}
+	enabled, handled, err := hsm.enabledTransitions(event, param, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(enabled) == 0 && hsm.isDeferred(event) {
+		preview.Deferred = true
+		preview.Leaves = hsm.ActiveStates()
+		return preview, nil
+	}
+	if !handled {
+		return nil, fmt.Errorf("%w in %s, current state:%s, event: %s",
+			ErrUnhandledEvent, hsm.Name, hsm.CurrentState, event)
+	}
+
+	// The transitions are simulated on the active configuration, which is
+	// restored once previewed.
+	leaves, current := hsm.leaves, hsm.CurrentState
+	history := make(map[State][]State, len(hsm.history))
+	for name, states := range hsm.history {
+		history[name] = states
+	}
+	defer func() {
+		hsm.leaves, hsm.CurrentState, hsm.history = leaves, current, history
+	}()
+
+	for _, et := range enabled {
+		if !hsm.isActive(et.source) {
+			continue
+		}
+		err := hsm.previewTransition(preview, et.segments, param, et.source)
+		if err != nil {
+			return nil, err
+		}
+	}
+	preview.Leaves = hsm.ActiveStates()
+	return preview, nil
+}
+
+// previewTransition adds the steps of a transition to the preview and sets
+// the resulting active configuration.
+func (hsm *Base) previewTransition(preview *Preview, segments []*Transition,
+	param interface{}, sourceState *StateInstance) error {
+
+	tran := segments[0]
+	if tran.NewState == "" {
+		preview.addActions(sourceState, segments)
+		return nil
+	}
+	targetState, err := hsm.lookupState(segments[len(segments)-1].NewState)
+	if err != nil {
+		return err
+	}
+	domain := hsm.leastCommonAncestor(sourceState, targetState)
+	return hsm.previewSegments(preview, segments, param, sourceState, domain,
+		targetState)
+}
+
+// previewSegments mirrors runTransition, without running any action.
+func (hsm *Base) previewSegments(preview *Preview, segments []*Transition,
+	param interface{}, sourceState *StateInstance, domain *StateInstance,
+	targetState *StateInstance) error {
+
+	exitSet := hsm.exitSet(domain)
+	entrySet := []*StateInstance{}
+	if targetState.kind != choiceState {
+		entrySet = hsm.entrySet(domain, targetState, exitSet)
+	}
+	for _, state := range exitSet {
+		preview.addStep(ExitPhase, state, state.exitActionList())
+	}
+	segments, sourceState = hsm.previewActions(preview, segments,
+		sourceState, entrySet)
+	hsm.recordHistory(exitSet)
+	hsm.setConfiguration(exitSet, entrySet)
+	if targetState.kind == choiceState {
+		branches, err := hsm.selectTransition(targetState, "", param)
+		if err != nil {
+			return err
+		}
+		if branches == nil {
+			return fmt.Errorf("no branch allowed for choice %s in %s",
+				targetState.Name, hsm.Name)
+		}
+		branchTarget, err := hsm.lookupState(
+			branches[len(branches)-1].NewState)
+		if err != nil {
+			return err
+		}
+		if domain != nil && !domain.contains(branchTarget) {
+			domain = hsm.leastCommonAncestor(domain, branchTarget)
+		}
+		return hsm.previewSegments(preview, branches, param, targetState,
+			domain, branchTarget)
+	}
+	for i, state := range entrySet {
+		preview.addStep(EntryPhase, state, state.entryActionList())
+		segments, sourceState = hsm.previewActions(preview, segments,
+			sourceState, entrySet[i+1:])
+	}
+	return nil
+}
+
+// previewActions mirrors runSegments, adding the transition actions of the
+// segments ready before the unentered states are entered.
+func (hsm *Base) previewActions(preview *Preview, segments []*Transition,
+	sourceState *StateInstance,
+	unentered []*StateInstance) ([]*Transition, *StateInstance) {
+
+	n := hsm.readySegments(segments, sourceState, unentered)
+	if n == 0 {
+		return segments, sourceState
+	}
+	preview.addActions(sourceState, segments[:n])
+	return segments[n:], hsm.states[segments[n-1].NewState]
+}
+
+// addActions adds the transition actions of the segments, if any.
+func (preview *Preview) addActions(source *StateInstance,
+	segments []*Transition) {
+
+	actions := []interface{}{}
+	for _, tran := range segments {
+		actions = append(actions, tran.actions()...)
+	}
+	if len(actions) > 0 {
+		preview.addStep(TransitionPhase, source, actions)
+	}
+}
+
+func (preview *Preview) addStep(phase ActionPhase, state *StateInstance,
+	actions []interface{}) {
+
+	names := []string{}
+	for _, action := range actions {
+		names = append(names, funcName(action))
+	}
+	preview.Steps = append(preview.Steps,
+		PreviewStep{Phase: phase, State: state.Name, Actions: names})
+}
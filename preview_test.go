@@ -0,0 +1,102 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPreview(t *testing.T) {
+
+	Convey("CASE: Dry Runs of Events", t, func() {
+		tr := &trace{}
+		sm := newRegionsHSM(tr)
+		sm.On()
+		*tr = nil
+
+		Convey("1. CanInject evaluates guards without running actions\n", func() {
+			ok, err := sm.CanInject(evStart, nil)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, err = sm.CanInject(evToggle, nil)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeFalse)
+			So(*tr, ShouldBeEmpty)
+		})
+
+		Convey("2. Preview lists the exited and entered states in order\n", func() {
+			preview, err := sm.Preview(evStart, nil)
+			So(err, ShouldBeNil)
+			states := []hsm.State{}
+			for _, step := range preview.Steps {
+				states = append(states, step.State)
+			}
+			So(states, ShouldResemble, []hsm.State{stIdle, stRunning,
+				stMotor, stMotorOff, stLamp, stLampOff})
+			So(preview.Steps[0].Phase, ShouldEqual, hsm.ExitPhase)
+			So(preview.Steps[1].Phase, ShouldEqual, hsm.EntryPhase)
+			So(preview.Leaves, ShouldResemble,
+				[]hsm.State{stMotorOff, stLampOff})
+		})
+
+		Convey("3. Preview leaves the machine unchanged\n", func() {
+			sm.Inject(evStart, nil)
+			sm.Inject(evToggle, nil)
+			*tr = nil
+			preview, err := sm.Preview(evFault, nil)
+			So(err, ShouldBeNil)
+			So(preview.Leaves, ShouldResemble, []hsm.State{stIdle})
+			So(sm.CurrentState, ShouldEqual, stRunning)
+			So(sm.ActiveStates(), ShouldResemble,
+				[]hsm.State{stMotorOn, stLampOn})
+			So(*tr, ShouldBeEmpty)
+		})
+
+		Convey("4. Unhandled events cannot be previewed\n", func() {
+			_, err := sm.Preview(evStop, nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("CASE: Dry Runs through Pseudostates", t, func() {
+		tr := &trace{}
+		sm := newPseudostatesHSM(tr)
+		sm.On()
+		*tr = nil
+
+		Convey("1. Preview follows the branch selected by the choice\n", func() {
+			preview, err := sm.Preview(evRoute, "b")
+			So(err, ShouldBeNil)
+			So(preview.Leaves, ShouldResemble, []hsm.State{stRouteB})
+			So(sm.CurrentState, ShouldEqual, stReady)
+			So(*tr, ShouldResemble, trace{"guard a", "guard b"})
+		})
+
+		Convey("2. Transition actions are listed by name\n", func() {
+			preview, err := sm.Preview(evJump, "a")
+			So(err, ShouldBeNil)
+			So(preview.Steps, ShouldHaveLength, 3)
+			So(preview.Steps[1].Phase, ShouldEqual, hsm.TransitionPhase)
+			So(preview.Steps[1].Actions, ShouldResemble, []string{
+				"hsm_test.(*trace).action.func1",
+				"hsm_test.(*trace).action.func1"})
+			So(preview.Steps[2].State, ShouldEqual, stRouteA)
+		})
+	})
+
+	Convey("CASE: Dry Runs of Deferred Events", t, func() {
+		sent := []interface{}{}
+		sm := newDeferHSM(&sent)
+		sm.On()
+
+		Convey("1. Preview reports deferred events\n", func() {
+			preview, err := sm.Preview(evSend, "hello")
+			So(err, ShouldBeNil)
+			So(preview.Deferred, ShouldBeTrue)
+			So(preview.Steps, ShouldBeEmpty)
+			ok, _ := sm.CanInject(evSend, "hello")
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
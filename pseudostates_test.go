@@ -0,0 +1,110 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evRoute    hsm.Event = "route"
+	evJump     hsm.Event = "jump"
+	stRouter   hsm.State = "router"
+	stReady    hsm.State = "ready"
+	stRouteA   hsm.State = "routeA"
+	stRouteB   hsm.State = "routeB"
+	stRouteC   hsm.State = "routeC"
+	stChoice   hsm.State = "choice"
+	stJunction hsm.State = "junction"
+)
+
+func (tr *trace) action(name string) hsm.ActionFunc {
+	return func(param interface{}) error {
+		*tr = append(*tr, name+" action")
+		return nil
+	}
+}
+
+func (tr *trace) paramIs(value string) hsm.GuardFunc {
+	return func(param interface{}) (bool, error) {
+		*tr = append(*tr, "guard "+value)
+		return param.(string) == value, nil
+	}
+}
+
+// newPseudostatesHSM builds a router whose ready state branches to routeA,
+// routeB or routeC through a choice on the route event and through a
+// junction on the jump event.
+func newPseudostatesHSM(tr *trace) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("pseudostatesHSM")
+
+	router := sm.NewState(stRouter)
+	router.AddTransitions([]hsm.Transition{
+		{On: evJump, NewState: stRouteC}})
+	ready := sm.NewState(stReady)
+	ready.AddExitActions(tr.exit(string(stReady)))
+	ready.AddTransitions([]hsm.Transition{
+		{On: evRoute, NewState: stChoice, Action: tr.action(string(evRoute))},
+		{On: evJump, NewState: stJunction, Action: tr.action(string(evJump))},
+	})
+	routeA := sm.NewState(stRouteA)
+	routeA.AddEntryActions(tr.entry(string(stRouteA)))
+	routeB := sm.NewState(stRouteB)
+	routeB.AddEntryActions(tr.entry(string(stRouteB)))
+	routeC := sm.NewState(stRouteC)
+	routeC.AddEntryActions(tr.entry(string(stRouteC)))
+
+	choice := sm.NewChoice(stChoice)
+	choice.AddTransitions([]hsm.Transition{
+		{NewState: stRouteA, Guard: tr.paramIs("a")},
+		{NewState: stRouteB, Guard: tr.paramIs("b")},
+		{NewState: stRouteC, Else: true},
+	})
+	junction := sm.NewJunction(stJunction)
+	junction.AddTransitions([]hsm.Transition{
+		{NewState: stRouteA, Guard: tr.paramIs("a"),
+			Action: tr.action(string(stJunction))},
+		{NewState: stRouteB, Guard: tr.paramIs("b")},
+	})
+
+	router.AddChildren(ready, routeA, routeB, routeC, choice, junction)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestPseudostates(t *testing.T) {
+
+	Convey("CASE: Choice and Junction Pseudostates", t, func() {
+		tr := &trace{}
+		sm := newPseudostatesHSM(tr)
+		sm.On()
+		*tr = nil
+
+		Convey("1. Choice branches are evaluated after exit actions run\n", func() {
+			So(sm.Inject(evRoute, "b"), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stRouteB)
+			So(*tr, ShouldResemble, trace{"ready exit", "route action",
+				"guard a", "guard b", "routeB entry"})
+		})
+
+		Convey("2. Choice takes its else branch when every guard rejects\n", func() {
+			So(sm.Inject(evRoute, "z"), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stRouteC)
+		})
+
+		Convey("3. Junction branches are evaluated before any action runs\n", func() {
+			So(sm.Inject(evJump, "a"), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stRouteA)
+			So(*tr, ShouldResemble, trace{"guard a", "ready exit",
+				"jump action", "junction action", "routeA entry"})
+		})
+
+		Convey("4. A blocked junction lets the event fall through\n", func() {
+			So(sm.Inject(evJump, "z"), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stRouteC)
+		})
+	})
+}
@@ -0,0 +1,205 @@
+package hsm
+
+import (
+	"context"
+	"fmt"
+)
+
+// queuedEvent is an event posted to the event queue with its param.  A
+// deferred event keeps the context it was injected with, if any.
+type queuedEvent struct {
+	event Event
+	param interface{}
+	ctx   context.Context
+}
+
+// Post adds an event to the event queue without waiting for it to be
+// dispatched.  Queued events are dispatched one at a time, run to
+// completion, in the order they were posted: by the run loop, see Run and
+// Start, or when the current call to Inject completes.  Actions post
+// follow-up events with Post, which are dispatched once the transition
+// running the action has completed.  A warning is logged if no state handles
+// or defers the event.
+func (hsm *Base) Post(event Event, param interface{}) {
+	if !hsm.definesEvent(event) {
+		hsm.log.WithFields(Fields{
+			"on": event,
+		}).Warn("posted event is never handled")
+	}
+	hsm.post(event, param)
+}
+
+// post implements Post.
+func (hsm *Base) post(event Event, param interface{}) {
+	hsm.queueLock.Lock()
+	hsm.queue = append(hsm.queue, queuedEvent{event, param, nil})
+	hsm.queueLock.Unlock()
+
+	// Wake the run loop, if it is not already awake.
+	select {
+	case hsm.queueSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches posted events until Stop is called, blocking the calling
+// goroutine.  An error is returned if the run loop is already running.
+func (hsm *Base) Run() error {
+	stop, done, err := hsm.startLoop()
+	if err != nil {
+		return err
+	}
+	hsm.loop(stop, done)
+	return nil
+}
+
+// Start runs the run loop, which dispatches posted events, on its own
+// goroutine until Stop is called.  An error is returned if the run loop is
+// already running.
+func (hsm *Base) Start() error {
+	stop, done, err := hsm.startLoop()
+	if err != nil {
+		return err
+	}
+	go hsm.loop(stop, done)
+	return nil
+}
+
+// Stop stops the run loop once the event being dispatched, if any, has run
+// to completion.  Events still queued remain queued.  Stop must not be
+// called from an action, as it waits for the run loop to exit.
+func (hsm *Base) Stop() {
+	hsm.queueLock.Lock()
+	stop, done := hsm.stopLoop, hsm.loopDone
+	hsm.stopLoop, hsm.loopDone = nil, nil
+	hsm.queueLock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
+
+func (hsm *Base) startLoop() (chan struct{}, chan struct{}, error) {
+	hsm.queueLock.Lock()
+	defer hsm.queueLock.Unlock()
+	if hsm.stopLoop != nil {
+		err := fmt.Errorf("run loop of hsm %s is already running", hsm.Name)
+		hsm.log.Error(err)
+		return nil, nil, err
+	}
+	hsm.stopLoop = make(chan struct{})
+	hsm.loopDone = make(chan struct{})
+	return hsm.stopLoop, hsm.loopDone, nil
+}
+
+func (hsm *Base) loop(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	for {
+		// Dispatch any events posted before the loop started.
+		hsm.Lock()
+		hsm.dispatchQueued()
+		hsm.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-hsm.queueSignal:
+		}
+	}
+}
+
+// dispatchQueued dispatches queued events, in order, until the queue is
+// empty.  Errors are logged, as there is no caller to return them to.
+// Events remain queued while the state machine is not on.  The caller must
+// hold the RTC lock.
+func (hsm *Base) dispatchQueued() {
+	for hsm.runState == ON {
+		hsm.queueLock.Lock()
+		if len(hsm.queue) == 0 {
+			hsm.queueLock.Unlock()
+			return
+		}
+		next := hsm.queue[0]
+		hsm.queue = hsm.queue[1:]
+		hsm.queueLock.Unlock()
+
+		err := hsm.record(next.event, next.param)
+		if err == nil {
+			err = hsm.dispatch(next.event, next.param)
+		}
+		if err != nil {
+			hsm.log.WithFields(Fields{
+				"on":    next.event,
+				"param": next.param,
+			}).Error("posted event failed: ", err)
+		}
+		hsm.dispatchDeferred()
+		hsm.checkpointStep()
+	}
+}
+
+// isDeferred returns true if an active state defers the event.
+func (hsm *Base) isDeferred(event Event) bool {
+	for _, state := range hsm.activeStates() {
+		for _, deferred := range state.deferred {
+			if deferred == event {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dispatchDeferred dispatches, in the order they arrived, the deferred events
+// that no active state defers any longer, until none remain to be released.
+// An event deferred again keeps its position among the deferred events.
+// Each event is dispatched with the context it was injected with, and is
+// discarded if the context is done.  Errors are logged, as there is no
+// caller to return them to.  The caller must hold the RTC lock.
+func (hsm *Base) dispatchDeferred() {
+	for released := true; released && hsm.runState == ON; {
+		released = false
+		for i, next := range hsm.deferred {
+			if hsm.isDeferred(next.event) {
+				continue
+			}
+			hsm.deferred = append(hsm.deferred[:i:i], hsm.deferred[i+1:]...)
+			released = true
+
+			remaining := len(hsm.deferred)
+			ctx := hsm.ctx
+			hsm.ctx = next.ctx
+			var err error
+			if next.ctx != nil {
+				err = next.ctx.Err()
+			}
+			if err == nil {
+				err = hsm.dispatch(next.event, next.param)
+			}
+			hsm.ctx = ctx
+			if len(hsm.deferred) > remaining {
+				// Only the event dispatched is deferred by its dispatch.
+				last := len(hsm.deferred) - 1
+				again := hsm.deferred[last]
+				copy(hsm.deferred[i+1:], hsm.deferred[i:last])
+				hsm.deferred[i] = again
+			}
+			if err != nil {
+				hsm.log.WithFields(Fields{
+					"on":    next.event,
+					"param": next.param,
+				}).Error("deferred event failed: ", err)
+			}
+			break
+		}
+	}
+}
+
+// clearQueue discards every queued and deferred event.
+func (hsm *Base) clearQueue() {
+	hsm.queueLock.Lock()
+	hsm.queue = nil
+	hsm.queueLock.Unlock()
+	hsm.deferred = nil
+}
@@ -0,0 +1,102 @@
+package hsm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evBegin    hsm.Event = "begin"
+	evWorkDone hsm.Event = "workDone"
+	stQueue    hsm.State = "queue"
+	stPending  hsm.State = "pending"
+	stWorking  hsm.State = "working"
+	stComplete hsm.State = "complete"
+)
+
+// newQueueHSM builds a machine whose working state posts the workDone event
+// from its entry action.  complete signals its entry on the channel.
+func newQueueHSM(tr *trace, entered chan hsm.State) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("queueHSM")
+
+	queue := sm.NewState(stQueue)
+	pending := sm.NewState(stPending)
+	pending.AddTransitions([]hsm.Transition{
+		{On: evBegin, NewState: stWorking}})
+	working := sm.NewState(stWorking)
+	working.AddEntryActions(
+		func(param interface{}) error {
+			sm.Post(evWorkDone, param)
+			return nil
+		},
+		tr.entry(string(stWorking)))
+	working.AddExitActions(tr.exit(string(stWorking)))
+	working.AddTransitions([]hsm.Transition{
+		{On: evWorkDone, NewState: stComplete}})
+	complete := sm.NewState(stComplete)
+	complete.AddEntryActions(func(param interface{}) error {
+		entered <- stComplete
+		return nil
+	})
+
+	queue.AddChildren(pending, working, complete)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestEventQueue(t *testing.T) {
+
+	Convey("CASE: Event Queue and Run Loop", t, func() {
+		tr := &trace{}
+		entered := make(chan hsm.State, 1)
+		sm := newQueueHSM(tr, entered)
+		sm.On()
+
+		Convey("1. Events posted by actions run after the transition completes\n", func() {
+			So(sm.Inject(evBegin, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stComplete)
+			So(*tr, ShouldResemble, trace{"working entry", "working exit"})
+		})
+
+		Convey("2. The run loop dispatches posted events on its own goroutine\n", func() {
+			So(sm.Start(), ShouldBeNil)
+			So(sm.Start(), ShouldNotBeNil)
+			sm.Post(evBegin, nil)
+			var state hsm.State
+			select {
+			case state = <-entered:
+			case <-time.After(time.Second):
+			}
+			sm.Stop()
+			So(state, ShouldEqual, stComplete)
+		})
+
+		Convey("3. Turning the machine off discards queued events\n", func() {
+			sm.Post(evBegin, nil)
+			So(sm.CurrentState, ShouldEqual, stPending)
+			So(sm.Off(), ShouldBeNil)
+			So(sm.On(), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stPending)
+		})
+
+		Convey("4. The machine can be turned off and on while the run loop runs\n", func() {
+			So(sm.Start(), ShouldBeNil)
+			sm.Post(evBegin, nil)
+			var state hsm.State
+			select {
+			case state = <-entered:
+			case <-time.After(time.Second):
+			}
+			So(sm.Off(), ShouldBeNil)
+			So(sm.On(), ShouldBeNil)
+			sm.Stop()
+			So(state, ShouldEqual, stComplete)
+			So(sm.CurrentState, ShouldEqual, stPending)
+		})
+	})
+}
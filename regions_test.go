@@ -0,0 +1,146 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evStart    hsm.Event = "start"
+	evStop     hsm.Event = "stop"
+	evToggle   hsm.Event = "toggle"
+	evFault    hsm.Event = "fault"
+	evCross    hsm.Event = "cross"
+	stTop      hsm.State = "top"
+	stIdle     hsm.State = "idle"
+	stRunning  hsm.State = "running"
+	stMotor    hsm.State = "motor"
+	stMotorOff hsm.State = "motorOff"
+	stMotorOn  hsm.State = "motorOn"
+	stLamp     hsm.State = "lamp"
+	stLampOff  hsm.State = "lampOff"
+	stLampOn   hsm.State = "lampOn"
+)
+
+// trace records entry and exit actions in the order they run.
+type trace []string
+
+func (tr *trace) entry(name string) hsm.ActionFunc {
+	return func(param interface{}) error {
+		*tr = append(*tr, name+" entry")
+		return nil
+	}
+}
+
+func (tr *trace) exit(name string) hsm.ActionFunc {
+	return func(param interface{}) error {
+		*tr = append(*tr, name+" exit")
+		return nil
+	}
+}
+
+// newRegionsHSM builds:
+//
+//	top
+//	├── idle
+//	└── running
+//	    ├── motor (region)
+//	    │   ├── motorOff
+//	    │   └── motorOn
+//	    └── lamp (region)
+//	        ├── lampOff
+//	        └── lampOn
+//
+// motorOn crosses to lampOff, in the other region, on the cross event.
+func newRegionsHSM(tr *trace) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("regionsHSM")
+
+	states := map[hsm.State]*hsm.StateInstance{}
+	for _, name := range []hsm.State{stTop, stIdle, stRunning, stMotor,
+		stMotorOff, stMotorOn, stLamp, stLampOff, stLampOn} {
+		states[name] = sm.NewState(name)
+		states[name].AddEntryActions(tr.entry(string(name)))
+		states[name].AddExitActions(tr.exit(string(name)))
+	}
+	states[stIdle].AddTransitions([]hsm.Transition{
+		{On: evStart, NewState: stRunning}})
+	states[stRunning].AddTransitions([]hsm.Transition{
+		{On: evStop, NewState: stIdle}})
+	states[stMotorOff].AddTransitions([]hsm.Transition{
+		{On: evToggle, NewState: stMotorOn}})
+	states[stMotorOn].AddTransitions([]hsm.Transition{
+		{On: evFault, NewState: stIdle},
+		{On: evCross, NewState: stLampOff},
+	})
+	states[stLampOff].AddTransitions([]hsm.Transition{
+		{On: evToggle, NewState: stLampOn}})
+	states[stLampOn].AddTransitions([]hsm.Transition{
+		{On: evFault, NewState: stLampOff}})
+
+	states[stTop].AddChildren(states[stIdle], states[stRunning])
+	states[stRunning].AddRegions(states[stMotor], states[stLamp])
+	states[stMotor].AddChildren(states[stMotorOff], states[stMotorOn])
+	states[stLamp].AddChildren(states[stLampOff], states[stLampOn])
+
+	sm.Finalize()
+	return sm
+}
+
+func TestRegions(t *testing.T) {
+
+	Convey("CASE: Orthogonal Regions", t, func() {
+		tr := &trace{}
+		sm := newRegionsHSM(tr)
+		sm.On()
+		*tr = nil
+
+		Convey("1. Entering an orthogonal state enters every region\n", func() {
+			So(sm.Inject(evStart, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stRunning)
+			So(sm.ActiveStates(), ShouldResemble,
+				[]hsm.State{stMotorOff, stLampOff})
+			So(*tr, ShouldResemble, trace{"idle exit", "running entry",
+				"motor entry", "motorOff entry", "lamp entry", "lampOff entry"})
+		})
+
+		Convey("2. Events are dispatched to every active region\n", func() {
+			sm.Inject(evStart, nil)
+			So(sm.Inject(evToggle, nil), ShouldBeNil)
+			So(sm.ActiveStates(), ShouldResemble,
+				[]hsm.State{stMotorOn, stLampOn})
+		})
+
+		Convey("3. Exiting an orthogonal state exits every region\n", func() {
+			sm.Inject(evStart, nil)
+			sm.Inject(evToggle, nil)
+			*tr = nil
+			So(sm.Inject(evStop, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stIdle)
+			So(*tr, ShouldResemble, trace{"lampOn exit", "lamp exit",
+				"motorOn exit", "motor exit", "running exit", "idle entry"})
+		})
+
+		Convey("4. A transition leaving the orthogonal state preempts other regions\n", func() {
+			sm.Inject(evStart, nil)
+			sm.Inject(evToggle, nil)
+			So(sm.Inject(evFault, nil), ShouldBeNil)
+			So(sm.ActiveStates(), ShouldResemble, []hsm.State{stIdle})
+		})
+
+		Convey("5. A transition between regions re-enters the orthogonal state\n", func() {
+			sm.Inject(evStart, nil)
+			sm.Inject(evToggle, nil)
+			*tr = nil
+			So(sm.Inject(evCross, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stRunning)
+			So(sm.ActiveStates(), ShouldResemble,
+				[]hsm.State{stMotorOff, stLampOff})
+			So(*tr, ShouldResemble, trace{"lampOn exit", "lamp exit",
+				"motorOn exit", "motor exit", "running exit", "running entry",
+				"motor entry", "motorOff entry", "lamp entry", "lampOff entry"})
+		})
+	})
+}
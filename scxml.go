@@ -0,0 +1,433 @@
+package hsm
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	scxmlNamespace = "http://www.w3.org/2005/07/scxml"
+	// scxmlDoneEvent prefixes the SCXML event raised when a state completes.
+	scxmlDoneEvent = "done.state."
+)
+
+// scxmlDocument is the scxml root element.
+type scxmlDocument struct {
+	XMLName xml.Name       `xml:"scxml"`
+	Xmlns   string         `xml:"xmlns,attr,omitempty"`
+	Version string         `xml:"version,attr,omitempty"`
+	Name    string         `xml:"name,attr,omitempty"`
+	Initial string         `xml:"initial,attr,omitempty"`
+	States  []scxmlElement `xml:",any"`
+}
+
+// scxmlElement is a state, parallel, final or history element.
+type scxmlElement struct {
+	XMLName     xml.Name          `xml:""`
+	ID          State             `xml:"id,attr"`
+	Initial     State             `xml:"initial,attr,omitempty"`
+	Type        string            `xml:"type,attr,omitempty"`
+	OnEntry     []scxmlExecutable `xml:"onentry"`
+	OnExit      []scxmlExecutable `xml:"onexit"`
+	Transitions []scxmlTransition `xml:"transition"`
+	States      []scxmlElement    `xml:",any"`
+}
+
+type scxmlTransition struct {
+	Event   string        `xml:"event,attr,omitempty"`
+	Cond    string        `xml:"cond,attr,omitempty"`
+	Target  State         `xml:"target,attr,omitempty"`
+	Type    string        `xml:"type,attr,omitempty"`
+	Scripts []scxmlScript `xml:"script"`
+}
+
+// scxmlExecutable is onentry or onexit executable content.
+type scxmlExecutable struct {
+	Scripts []scxmlScript `xml:"script"`
+}
+
+// scxmlScript names a registered action.
+type scxmlScript struct {
+	Name string `xml:",chardata"`
+}
+
+// LoadSCXML configures and finalizes the state machine from a W3C SCXML
+// document.  The state, parallel, final and history elements build the
+// state hierarchy, with the initial attribute or element selecting default
+// states among the children of a state.
+// The cond of a transition names a guard, and the script elements of
+// transitions, onentry and onexit each name an action, bound through the
+// registry.  A transition on the done.state.<id> event of its own state is
+// the state's completion transition.  Other executable content, eventless
+// transitions and transitions with several targets are not supported.
+func (hsm *Base) LoadSCXML(data []byte, registry *Registry) error {
+	doc := &scxmlDocument{}
+	if err := xml.Unmarshal(data, doc); err != nil {
+		return fmt.Errorf("cannot load scxml document: %v", err)
+	}
+	name := doc.Name
+	if name == "" {
+		name = "scxml"
+	}
+	hsm.Configure(name)
+
+	top := scxmlElement{
+		XMLName: xml.Name{Local: "state"},
+		ID:      State(name),
+		Initial: State(doc.Initial),
+		States:  doc.States,
+	}
+	if len(doc.States) == 1 {
+		top = doc.States[0]
+	}
+	if _, err := hsm.loadSCXMLState(&top, registry); err != nil {
+		hsm.log.Error(err)
+		return err
+	}
+	return hsm.Finalize()
+}
+
+// loadSCXMLState creates the state of an element and, recursively, its
+// children.
+func (hsm *Base) loadSCXMLState(elem *scxmlElement,
+	registry *Registry) (*StateInstance, error) {
+
+	var state *StateInstance
+	switch elem.XMLName.Local {
+	case "state", "parallel":
+		state = hsm.NewState(elem.ID)
+	case "final":
+		state = hsm.NewFinalState(elem.ID)
+	case "history":
+		if elem.Type == "deep" {
+			state = hsm.NewDeepHistory(elem.ID)
+		} else {
+			state = hsm.NewShallowHistory(elem.ID)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported scxml element %s",
+			elem.XMLName.Local)
+	}
+	if state == nil {
+		return nil, fmt.Errorf("cannot add state %s to hsm %s", elem.ID,
+			hsm.Name)
+	}
+
+	for _, onEntry := range elem.OnEntry {
+		actions, err := scxmlActions(onEntry.Scripts, registry)
+		if err != nil {
+			return nil, fmt.Errorf("onentry of state %s: %v", state.Name, err)
+		}
+		state.AddEntryActions(actions...)
+	}
+	for _, onExit := range elem.OnExit {
+		actions, err := scxmlActions(onExit.Scripts, registry)
+		if err != nil {
+			return nil, fmt.Errorf("onexit of state %s: %v", state.Name, err)
+		}
+		state.AddExitActions(actions...)
+	}
+
+	trans := []Transition{}
+	for _, scxmlTran := range elem.Transitions {
+		tran, err := scxmlTransitionOf(state, scxmlTran, registry)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range strings.Fields(scxmlTran.Event) {
+			tran.On = Event(event)
+			if event == scxmlDoneEvent+string(state.Name) {
+				tran.On = ""
+			}
+			trans = append(trans, tran)
+		}
+	}
+	state.AddTransitions(trans)
+
+	initial := elem.Initial
+	children := []*StateInstance{}
+	for i := range elem.States {
+		if elem.States[i].XMLName.Local == "initial" {
+			target, err := scxmlInitialOf(state, initial, &elem.States[i])
+			if err != nil {
+				return nil, err
+			}
+			initial = target
+			continue
+		}
+		child, err := hsm.loadSCXMLState(&elem.States[i], registry)
+		if err != nil {
+			return nil, err
+		}
+		children = append(children, child)
+	}
+	if elem.XMLName.Local == "parallel" {
+		state.AddRegions(children...)
+	} else if len(children) > 0 {
+		state.AddChildren(children...)
+	}
+	if initial != "" && elem.XMLName.Local != "parallel" {
+		if !scxmlIsDefault(children, initial) {
+			return nil, fmt.Errorf("initial state %s of state %s is not "+
+				"one of its child states", initial, state.Name)
+		}
+		state.initialState = initial
+	}
+	return state, nil
+}
+
+// scxmlInitialOf returns the target of an initial element, which must hold
+// a single transition to a single target, without executable content.
+func scxmlInitialOf(state *StateInstance, initial State,
+	elem *scxmlElement) (State, error) {
+
+	if initial != "" {
+		return "", fmt.Errorf("state %s has both an initial attribute and "+
+			"an initial element", state.Name)
+	}
+	if len(elem.Transitions) != 1 || len(elem.States) > 0 {
+		return "", fmt.Errorf("initial element of state %s must hold a "+
+			"single transition", state.Name)
+	}
+	tran := elem.Transitions[0]
+	if len(strings.Fields(string(tran.Target))) != 1 ||
+		len(tran.Scripts) > 0 || tran.Event != "" || tran.Cond != "" {
+		return "", fmt.Errorf("initial transition of state %s must have "+
+			"a single target and no event, cond or script", state.Name)
+	}
+	return tran.Target, nil
+}
+
+// scxmlIsDefault returns true if the named state is one of the children and
+// can be a default state.
+func scxmlIsDefault(children []*StateInstance, name State) bool {
+	for _, child := range children {
+		if child.Name == name {
+			return child.kind == regularState
+		}
+	}
+	return false
+}
+
+// scxmlTransitionOf converts an SCXML transition, leaving its event unset.
+func scxmlTransitionOf(state *StateInstance, scxmlTran scxmlTransition,
+	registry *Registry) (Transition, error) {
+
+	tran := Transition{NewState: scxmlTran.Target}
+	if scxmlTran.Event == "" {
+		return tran, fmt.Errorf("eventless transition of state %s is not "+
+			"supported", state.Name)
+	}
+	if len(strings.Fields(string(scxmlTran.Target))) > 1 {
+		return tran, fmt.Errorf("transition of state %s has several targets",
+			state.Name)
+	}
+	guard, err := registry.guard(scxmlTran.Cond)
+	if err != nil {
+		return tran, fmt.Errorf("transition of state %s on %s: %v",
+			state.Name, scxmlTran.Event, err)
+	}
+	tran.Guard = guard
+	actions, err := scxmlActions(scxmlTran.Scripts, registry)
+	if err != nil {
+		return tran, fmt.Errorf("transition of state %s on %s: %v",
+			state.Name, scxmlTran.Event, err)
+	}
+	switch len(actions) {
+	case 0:
+	case 1:
+		tran.Action = actions[0]
+	default:
+		tran.Action = func(param interface{}) error {
+			for _, action := range actions {
+				if err := action(param); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return tran, nil
+}
+
+func scxmlActions(scripts []scxmlScript,
+	registry *Registry) ([]ActionFunc, error) {
+
+	actions := []ActionFunc{}
+	for _, script := range scripts {
+		action, err := registry.action(strings.TrimSpace(script.Name))
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// ExportSCXML writes the state machine as a W3C SCXML document.  Guards and
+// actions are written as the names they are bound to in the registry,
+// matched by function, or as their function names when not registered; the
+// registry may be nil.  Completion transitions are written on the
+// done.state.<id> event.  Choice and junction pseudostates, sub-machine
+// states, deferred events and context-aware actions and guards have no
+// SCXML equivalent and cannot be exported.
+func (hsm *Base) ExportSCXML(registry *Registry) ([]byte, error) {
+	top := hsm.userTopState()
+	if top == nil {
+		return nil, fmt.Errorf("cannot export hsm %s; it has no top state",
+			hsm.Name)
+	}
+	elem, err := hsm.scxmlElementOf(top, registry)
+	if err != nil {
+		hsm.log.Error(err)
+		return nil, err
+	}
+	doc := scxmlDocument{
+		Xmlns:   scxmlNamespace,
+		Version: "1.0",
+		Name:    hsm.Name,
+		Initial: string(top.Name),
+		States:  []scxmlElement{elem},
+	}
+	data, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+// userTopState returns the top state configured with NewState.
+func (hsm *Base) userTopState() *StateInstance {
+	for _, state := range hsm.configuredStates() {
+		if state.parent == nil || state.parent == hsm.topState {
+			return state
+		}
+	}
+	return nil
+}
+
+// scxmlElementOf converts a state and, recursively, its children.
+func (hsm *Base) scxmlElementOf(state *StateInstance,
+	registry *Registry) (scxmlElement, error) {
+
+	elem := scxmlElement{ID: state.Name}
+	switch state.kind {
+	case regularState:
+		elem.XMLName.Local = "state"
+		if state.parallel {
+			elem.XMLName.Local = "parallel"
+		} else if len(state.children) > 0 {
+			elem.Initial = state.initialState
+		}
+	case finalState:
+		elem.XMLName.Local = "final"
+	case shallowHistoryState, deepHistoryState:
+		elem.XMLName.Local = "history"
+		elem.Type = "shallow"
+		if state.kind == deepHistoryState {
+			elem.Type = "deep"
+		}
+	default:
+		return elem, fmt.Errorf("cannot export pseudostate %s to scxml",
+			state.Name)
+	}
+	if state.submachine != nil {
+		return elem, fmt.Errorf("cannot export sub-machine state %s to scxml",
+			state.Name)
+	}
+
+	if len(state.deferred) > 0 {
+		return elem, fmt.Errorf("cannot export deferred events of state %s "+
+			"to scxml", state.Name)
+	}
+	if len(state.contextEntryActions) > 0 || len(state.contextExitActions) > 0 {
+		return elem, fmt.Errorf("cannot export context actions of state %s "+
+			"to scxml", state.Name)
+	}
+	if len(state.entryActions) > 0 {
+		elem.OnEntry = []scxmlExecutable{{
+			Scripts: scxmlScripts(state.entryActions, registry)}}
+	}
+	if len(state.exitActions) > 0 {
+		elem.OnExit = []scxmlExecutable{{
+			Scripts: scxmlScripts(state.exitActions, registry)}}
+	}
+
+	for _, event := range sortedEvents(state) {
+		if event == hsmExitEvent {
+			continue
+		}
+		name := string(event)
+		if event == "" {
+			name = scxmlDoneEvent + string(state.Name)
+		}
+		// Else transitions are taken last, as SCXML evaluates transitions
+		// in document order.
+		trans := append([]*Transition{}, state.transitions[event]...)
+		sort.SliceStable(trans, func(i, j int) bool {
+			return !trans[i].Else && trans[j].Else
+		})
+		for _, tran := range trans {
+			if tran.ContextAction != nil || tran.ContextGuard != nil {
+				return elem, fmt.Errorf("cannot export context action or "+
+					"guard of transition on %s of state %s to scxml",
+					name, state.Name)
+			}
+			scxmlTran := scxmlTransition{Event: name, Target: tran.NewState}
+			if tran.Guard != nil {
+				scxmlTran.Cond = registry.nameOf(tran.Guard)
+			}
+			if tran.Action != nil {
+				scxmlTran.Scripts = scxmlScripts(
+					[]ActionFunc{tran.Action}, registry)
+			}
+			elem.Transitions = append(elem.Transitions, scxmlTran)
+		}
+	}
+
+	for _, child := range state.children {
+		childElem, err := hsm.scxmlElementOf(child, registry)
+		if err != nil {
+			return elem, err
+		}
+		elem.States = append(elem.States, childElem)
+	}
+	return elem, nil
+}
+
+func scxmlScripts(actions []ActionFunc, registry *Registry) []scxmlScript {
+	scripts := []scxmlScript{}
+	for _, action := range actions {
+		scripts = append(scripts, scxmlScript{Name: registry.nameOf(action)})
+	}
+	return scripts
+}
+
+// nameOf returns the name an action or guard is registered with, matching
+// functions by their code, or the function name if it is not registered.
+// Closures created by the same function literal share their code, so the
+// first matching name, in name order, is returned.
+func (registry *Registry) nameOf(fn interface{}) string {
+	if registry != nil {
+		pointer := reflect.ValueOf(fn).Pointer()
+		names := []string{}
+		for name, action := range registry.actions {
+			if reflect.ValueOf(action).Pointer() == pointer {
+				names = append(names, name)
+			}
+		}
+		for name, guard := range registry.guards {
+			if reflect.ValueOf(guard).Pointer() == pointer {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			return names[0]
+		}
+	}
+	return funcName(fn)
+}
@@ -0,0 +1,129 @@
+package hsm_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evHeat     hsm.Event = "heat"
+	evCool     hsm.Event = "cool"
+	evPower    hsm.Event = "power"
+	stOven     hsm.State = "oven"
+	stOvenOff  hsm.State = "ovenOff"
+	stOvenOn   hsm.State = "ovenOn"
+	stHeating  hsm.State = "heating"
+	stCooling  hsm.State = "cooling"
+	stOvenLast hsm.State = "ovenLast"
+)
+
+const (
+	ovenSCXML = `<?xml version="1.0" encoding="UTF-8"?>
+<scxml xmlns="http://www.w3.org/2005/07/scxml" version="1.0" name="ovenHSM">
+  <state id="oven" initial="ovenOff">
+    <state id="ovenOff">
+      <transition event="power" target="ovenLast"/>
+    </state>
+    <state id="ovenOn" initial="cooling">
+      <onentry><script>powerOn</script></onentry>
+      <transition event="power" target="ovenOff"/>
+      <state id="heating">
+        <transition event="cool" target="cooling"/>
+      </state>
+      <state id="cooling">
+        <transition event="heat" cond="safe" target="heating"/>
+      </state>
+      <history id="ovenLast" type="shallow"/>
+    </state>
+  </state>
+</scxml>`
+)
+
+func newOvenRegistry(tr *trace) *hsm.Registry {
+	registry := hsm.NewRegistry()
+	registry.AddAction("powerOn", tr.entry(string(stOvenOn)))
+	registry.AddGuard("safe", func(param interface{}) (bool, error) {
+		return param == "safe", nil
+	})
+	return registry
+}
+
+func TestSCXML(t *testing.T) {
+
+	Convey("CASE: SCXML Import and Export", t, func() {
+		tr := &trace{}
+		registry := newOvenRegistry(tr)
+		sm := &hsm.Base{}
+		So(sm.LoadSCXML([]byte(ovenSCXML), registry), ShouldBeNil)
+		So(sm.On(), ShouldBeNil)
+
+		Convey("1. An SCXML document builds the machine\n", func() {
+			So(sm.CurrentState, ShouldEqual, stOvenOff)
+			So(sm.Inject(evPower, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stCooling)
+			So(sm.Inject(evHeat, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stCooling)
+			So(sm.Inject(evHeat, "safe"), ShouldBeNil)
+			So(sm.Inject(evPower, nil), ShouldBeNil)
+			So(sm.Inject(evPower, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stHeating)
+			So(*tr, ShouldResemble, trace{"ovenOn entry", "ovenOn entry"})
+		})
+
+		Convey("2. An exported machine loads back unchanged\n", func() {
+			data, err := sm.ExportSCXML(registry)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring,
+				`<transition event="heat" cond="safe" target="heating"></transition>`)
+			So(string(data), ShouldContainSubstring, `<script>powerOn</script>`)
+
+			loaded := &hsm.Base{}
+			So(loaded.LoadSCXML(data, registry), ShouldBeNil)
+			exported, err := loaded.ExportSCXML(registry)
+			So(err, ShouldBeNil)
+			So(string(exported), ShouldEqual, string(data))
+		})
+
+		Convey("3. Unsupported elements fail the load\n", func() {
+			doc := strings.Replace(ovenSCXML, `<history id="ovenLast" type="shallow"/>`,
+				`<history id="ovenLast"/><datamodel/>`, 1)
+			So((&hsm.Base{}).LoadSCXML([]byte(doc), registry), ShouldNotBeNil)
+		})
+
+		Convey("4. An initial element selects the default state\n", func() {
+			doc := strings.Replace(ovenSCXML, `<state id="ovenOn" initial="cooling">`,
+				`<state id="ovenOn"><initial><transition target="cooling"/></initial>`, 1)
+			loaded := &hsm.Base{}
+			So(loaded.LoadSCXML([]byte(doc), registry), ShouldBeNil)
+			So(loaded.On(), ShouldBeNil)
+			So(loaded.Inject(evPower, nil), ShouldBeNil)
+			So(loaded.CurrentState, ShouldEqual, stCooling)
+		})
+
+		Convey("5. Initial states must be child states\n", func() {
+			doc := strings.Replace(ovenSCXML, `initial="cooling"`,
+				`initial="ovenOff"`, 1)
+			So((&hsm.Base{}).LoadSCXML([]byte(doc), registry), ShouldNotBeNil)
+			doc = strings.Replace(ovenSCXML, `<state id="ovenOn" initial="cooling">`,
+				`<state id="ovenOn" initial="cooling"><initial><transition target="heating"/></initial>`, 1)
+			So((&hsm.Base{}).LoadSCXML([]byte(doc), registry), ShouldNotBeNil)
+		})
+
+		Convey("6. Deferred events cannot be exported\n", func() {
+			sent := []interface{}{}
+			_, err := newDeferHSM(&sent).ExportSCXML(nil)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("7. Context actions and guards cannot be exported\n", func() {
+			var cancel context.CancelFunc
+			_, err := newContextHSM(&trace{}, &cancel).ExportSCXML(nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "context action")
+		})
+	})
+}
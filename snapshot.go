@@ -0,0 +1,301 @@
+package hsm
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// SnapshotVersion is the version of the snapshot format written by
+// Snapshot.
+const SnapshotVersion = 1
+
+// runLevelNames names the run levels stored in snapshots.
+var runLevelNames = map[hsmConfigState]string{
+	INITIALIZING: "initializing",
+	FINALIZED:    "finalized",
+	ON:           "on",
+	EXITING:      "exiting",
+	OFF:          "off",
+}
+
+// ParamCodec encodes and decodes event params, so that pending events can
+// be persisted.  The default codec uses JSON, decoding params as the
+// generic types of encoding/json.
+type ParamCodec interface {
+	Encode(event Event, param interface{}) ([]byte, error)
+	Decode(event Event, data []byte) (interface{}, error)
+}
+
+// jsonParamCodec is the default ParamCodec.
+type jsonParamCodec struct{}
+
+func (jsonParamCodec) Encode(event Event, param interface{}) ([]byte, error) {
+	return json.Marshal(param)
+}
+
+func (jsonParamCodec) Decode(event Event, data []byte) (interface{}, error) {
+	var param interface{}
+	err := json.Unmarshal(data, &param)
+	return param, err
+}
+
+// SetParamCodec replaces the codec of the event params persisted by the
+// machine.
+func (hsm *Base) SetParamCodec(codec ParamCodec) {
+	hsm.codec = codec
+}
+
+func (hsm *Base) paramCodec() ParamCodec {
+	if hsm.codec == nil {
+		return jsonParamCodec{}
+	}
+	return hsm.codec
+}
+
+// snapshot is the serialized form of a machine's state.
+type snapshot struct {
+	Version  int               `json:"version"`
+	Machine  string            `json:"machine"`
+	RunLevel string            `json:"runLevel"`
+	Active   []State           `json:"active"`
+	History  map[State][]State `json:"history,omitempty"`
+	Deferred []snapshotEvent   `json:"deferred,omitempty"`
+	Queued   []snapshotEvent   `json:"queued,omitempty"`
+	// Submachines holds the snapshots of the running sub-machines by the
+	// name of their sub-machine state.
+	Submachines map[State]json.RawMessage `json:"submachines,omitempty"`
+}
+
+type snapshotEvent struct {
+	Event Event  `json:"event"`
+	Param []byte `json:"param"`
+}
+
+// Snapshot serializes the state of the machine: its run level, active leaf
+// states, history, the deferred and queued events not yet dispatched, with
+// their params encoded by the param codec, and the snapshots of its running
+// sub-machines.  Armed time events are not saved; they are armed again when
+// the snapshot is restored.
+func (hsm *Base) Snapshot() ([]byte, error) {
+	hsm.Lock()
+	defer hsm.Unlock()
+	return hsm.snapshot()
+}
+
+// snapshot implements Snapshot.  The caller must hold the RTC lock.
+func (hsm *Base) snapshot() ([]byte, error) {
+	snap := snapshot{
+		Version:  SnapshotVersion,
+		Machine:  hsm.Name,
+		RunLevel: runLevelNames[hsm.runState],
+		Active:   hsm.ActiveStates(),
+		History:  hsm.history,
+	}
+	var err error
+	snap.Deferred, err = hsm.encodeEvents(hsm.deferred)
+	if err != nil {
+		return nil, err
+	}
+	hsm.queueLock.Lock()
+	queue := append([]queuedEvent{}, hsm.queue...)
+	hsm.queueLock.Unlock()
+	snap.Queued, err = hsm.encodeEvents(queue)
+	if err != nil {
+		return nil, err
+	}
+	for state, sub := range hsm.submachines {
+		data, err := sub.Snapshot()
+		if err != nil {
+			return nil, fmt.Errorf("cannot snapshot sub-machine %s: %v",
+				state.Name, err)
+		}
+		if snap.Submachines == nil {
+			snap.Submachines = make(map[State]json.RawMessage)
+		}
+		snap.Submachines[state.Name] = data
+	}
+	return json.Marshal(snap)
+}
+
+func (hsm *Base) encodeEvents(events []queuedEvent) ([]snapshotEvent, error) {
+	encoded := []snapshotEvent{}
+	for _, qe := range events {
+		param, err := hsm.paramCodec().Encode(qe.event, qe.param)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode param of event %s: %v",
+				qe.event, err)
+		}
+		encoded = append(encoded, snapshotEvent{qe.event, param})
+	}
+	return encoded, nil
+}
+
+func (hsm *Base) decodeEvents(events []snapshotEvent) ([]queuedEvent, error) {
+	decoded := []queuedEvent{}
+	for _, se := range events {
+		param, err := hsm.paramCodec().Decode(se.Event, se.Param)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decode param of event %s: %v",
+				se.Event, err)
+		}
+		decoded = append(decoded, queuedEvent{se.Event, param, nil})
+	}
+	return decoded, nil
+}
+
+// Restore restores a snapshot into a finalized machine, built with the same
+// states as the machine the snapshot was taken from, that is not on.  The
+// active states, history, run level, pending events and the sub-machines
+// of the active sub-machine states are restored without running any
+// action; a sub-machine missing from the snapshot is started.  The time
+// events of the active states are armed from the time of the restore.
+// Snapshots of another machine, by name, and snapshots whose active states
+// are not a legal configuration are refused.
+func (hsm *Base) Restore(data []byte) error {
+	hsm.Lock()
+	defer hsm.Unlock()
+
+	err := hsm.restore(data)
+	if err != nil {
+		hsm.log.Error(err)
+	}
+	return err
+}
+
+// restore implements Restore.  The caller must hold the RTC lock.
+func (hsm *Base) restore(data []byte) error {
+	if hsm.runState != FINALIZED && hsm.runState != OFF {
+		return fmt.Errorf("cannot restore hsm %s; it is on or not finalized",
+			hsm.Name)
+	}
+	snap := snapshot{}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("cannot restore hsm %s: %v", hsm.Name, err)
+	}
+	if snap.Version != SnapshotVersion {
+		return fmt.Errorf("cannot restore hsm %s from snapshot version %d",
+			hsm.Name, snap.Version)
+	}
+	if snap.Machine != hsm.Name {
+		return fmt.Errorf("cannot restore hsm %s from a snapshot of hsm %s",
+			hsm.Name, snap.Machine)
+	}
+
+	runState, ok := hsmConfigState(-1), false
+	for level, name := range runLevelNames {
+		if name == snap.RunLevel {
+			runState, ok = level, true
+		}
+	}
+	if !ok || (runState != FINALIZED && runState != ON && runState != OFF) {
+		return fmt.Errorf("cannot restore hsm %s to run level %s", hsm.Name,
+			snap.RunLevel)
+	}
+
+	leaves := []*StateInstance{}
+	for _, name := range snap.Active {
+		leaf, err := hsm.lookupState(name)
+		if err != nil {
+			return err
+		}
+		leaves = append(leaves, leaf)
+	}
+	if len(leaves) == 0 {
+		return fmt.Errorf("cannot restore hsm %s; no state is active",
+			hsm.Name)
+	}
+	if err := hsm.checkConfiguration(leaves, runState); err != nil {
+		return fmt.Errorf("cannot restore hsm %s; %v", hsm.Name, err)
+	}
+	for composite, names := range snap.History {
+		for _, name := range append([]State{composite}, names...) {
+			if _, err := hsm.lookupState(name); err != nil {
+				return err
+			}
+		}
+	}
+	deferred, err := hsm.decodeEvents(snap.Deferred)
+	if err != nil {
+		return err
+	}
+	queued, err := hsm.decodeEvents(snap.Queued)
+	if err != nil {
+		return err
+	}
+
+	hsm.history = make(map[State][]State)
+	for composite, names := range snap.History {
+		hsm.history[composite] = names
+	}
+	hsm.deferred = deferred
+	hsm.queueLock.Lock()
+	hsm.queue = queued
+	hsm.queueLock.Unlock()
+	hsm.completions = nil
+	hsm.runState = runState
+	hsm.restoreConfiguration(leaves)
+	if runState != ON {
+		for _, state := range hsm.activeStates() {
+			hsm.cancelTimers(state)
+		}
+		return nil
+	}
+	for _, leaf := range hsm.leaves {
+		err := hsm.resumeSubmachine(leaf, snap.Submachines[leaf.Name])
+		if err != nil {
+			return fmt.Errorf("cannot restore sub-machine %s: %v",
+				leaf.Name, err)
+		}
+	}
+	return nil
+}
+
+// checkConfiguration returns an error unless the leaves form a legal active
+// configuration for the run level: the top state alone, when the machine
+// is not on, or distinct leaf states activating exactly one child of each
+// active composite state and every region of each active orthogonal state.
+func (hsm *Base) checkConfiguration(leaves []*StateInstance,
+	runState hsmConfigState) error {
+
+	if len(leaves) == 1 && leaves[0] == hsm.topState {
+		if runState == ON {
+			return fmt.Errorf("no state is active while on")
+		}
+		return nil
+	}
+	active := []*StateInstance{}
+	for i, leaf := range leaves {
+		if len(leaf.children) > 0 ||
+			(leaf.kind != regularState && leaf.kind != finalState) {
+			return fmt.Errorf("active state %s is not a leaf state",
+				leaf.Name)
+		}
+		if containsState(leaves[:i], leaf) {
+			return fmt.Errorf("state %s is active more than once", leaf.Name)
+		}
+		for state := leaf; state != nil; state = state.parent {
+			if !containsState(active, state) {
+				active = append(active, state)
+			}
+		}
+	}
+	for _, state := range active {
+		if len(state.children) == 0 {
+			continue
+		}
+		children := 0
+		for _, child := range state.children {
+			if containsState(active, child) {
+				children++
+			} else if state.parallel && child.kind == regularState {
+				return fmt.Errorf("region %s of active state %s is not active",
+					child.Name, state.Name)
+			}
+		}
+		if !state.parallel && children != 1 {
+			return fmt.Errorf("%d children of active state %s are active",
+				children, state.Name)
+		}
+	}
+	return nil
+}
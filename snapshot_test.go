@@ -0,0 +1,113 @@
+package hsm_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// byteCodec encodes string params as their bytes.
+type byteCodec struct{}
+
+func (byteCodec) Encode(event hsm.Event, param interface{}) ([]byte, error) {
+	return []byte(param.(string)), nil
+}
+
+func (byteCodec) Decode(event hsm.Event, data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+// restoreActive restores a snapshot of the machine turned on with the
+// given JSON list of active states.
+func restoreActive(sm *hsm.Base, active string) error {
+	return sm.Restore([]byte(`{"version":1,"machine":"` + sm.Name +
+		`","runLevel":"on","active":` + active + `}`))
+}
+
+func TestSnapshots(t *testing.T) {
+
+	Convey("CASE: Snapshot and Restore", t, func() {
+		sent := []interface{}{}
+		sm := newDeferHSM(&sent)
+		sm.On()
+		sm.Inject(evSend, "hello")
+		data, err := sm.Snapshot()
+		So(err, ShouldBeNil)
+
+		Convey("1. A restored machine resumes with its pending events\n", func() {
+			restored := newDeferHSM(&sent)
+			So(restored.Restore(data), ShouldBeNil)
+			So(restored.CurrentState, ShouldEqual, stConnecting)
+			So(restored.Inject(evConnected, nil), ShouldBeNil)
+			So(restored.CurrentState, ShouldEqual, stSending)
+			So(sent, ShouldResemble, []interface{}{"hello"})
+		})
+
+		Convey("2. Restore runs no entry actions\n", func() {
+			tr := &trace{}
+			restored := newPseudostatesHSM(tr)
+			source := newPseudostatesHSM(&trace{})
+			source.On()
+			source.Inject(evRoute, "b")
+			data, err := source.Snapshot()
+			So(err, ShouldBeNil)
+			So(restored.Restore(data), ShouldBeNil)
+			So(restored.CurrentState, ShouldEqual, stRouteB)
+			So(*tr, ShouldBeEmpty)
+		})
+
+		Convey("3. Machines that are on or unknown versions are refused\n", func() {
+			So(sm.Restore(data), ShouldNotBeNil)
+			restored := newDeferHSM(&sent)
+			old := strings.Replace(string(data), `"version":1`, `"version":0`, 1)
+			So(restored.Restore([]byte(old)), ShouldNotBeNil)
+		})
+
+		Convey("4. Params are encoded with the param codec\n", func() {
+			sm.SetParamCodec(byteCodec{})
+			data, err := sm.Snapshot()
+			So(err, ShouldBeNil)
+			So(string(data), ShouldContainSubstring, `"param":"aGVsbG8="`)
+			restored := newDeferHSM(&sent)
+			restored.SetParamCodec(byteCodec{})
+			So(restored.Restore(data), ShouldBeNil)
+			restored.Inject(evConnected, nil)
+			So(sent, ShouldResemble, []interface{}{"hello"})
+		})
+
+		Convey("5. Snapshots of another machine are refused\n", func() {
+			restored := newDeferHSM(&sent)
+			other := strings.Replace(string(data), `"machine":"deferHSM"`,
+				`"machine":"otherHSM"`, 1)
+			So(restored.Restore([]byte(other)), ShouldNotBeNil)
+			So(restored.Restore(data), ShouldBeNil)
+		})
+
+		Convey("6. Restored active states must be leaf states\n", func() {
+			restored := newDeferHSM(&sent)
+			So(restoreActive(restored, `["connecting","link"]`), ShouldNotBeNil)
+			So(restoreActive(restored, `["TopState"]`), ShouldNotBeNil)
+			So(restoreActive(restored, `["connecting"]`), ShouldBeNil)
+		})
+
+		Convey("7. Restored composite states have exactly one active child\n", func() {
+			restored := newDeferHSM(&sent)
+			So(restoreActive(restored, `["connecting","linkUp"]`),
+				ShouldNotBeNil)
+			So(restoreActive(restored, `["connecting","connecting"]`),
+				ShouldNotBeNil)
+			So(restored.ActiveStates(), ShouldResemble,
+				[]hsm.State{"TopState"})
+		})
+
+		Convey("8. Restored orthogonal states have one active child per region\n", func() {
+			restored := newRegionsHSM(&trace{})
+			So(restoreActive(restored, `["motorOff"]`), ShouldNotBeNil)
+			So(restoreActive(restored, `["motorOff","motorOn","lampOff"]`),
+				ShouldNotBeNil)
+			So(restoreActive(restored, `["motorOff","lampOn"]`), ShouldBeNil)
+		})
+	})
+}
@@ -11,23 +11,61 @@ type GuardFunc func(param interface{}) (bool, error)
 
 // Transition defines an event for the state, the next state following
 // the event transition and any action that might occur during the
-// event transition.
+// event transition.  A state may define several transitions for the same
+// event; their guards are evaluated in declaration order and the first
+// transition allowed is taken.  An Else transition is taken only when the
+// guards of all the other transitions for the event reject it.
 type Transition struct {
 	On       Event
 	NewState State
 	Action   ActionFunc
 	Guard    GuardFunc
+	Else     bool
+	// Compensation undoes Action under the CompensateOnFailure policy.
+	Compensation ActionFunc
+	// ContextAction runs after Action, receiving the context of the event.
+	ContextAction ContextActionFunc
+	// ContextGuard, evaluated after Guard, must also allow the transition.
+	ContextGuard ContextGuardFunc
 }
 
+// stateKind enumeration type that distinguishes regular states from the
+// pseudostates a transition may target.
+type stateKind int
+
+// stateKind enumeration
+const (
+	regularState stateKind = iota
+	shallowHistoryState
+	deepHistoryState
+	choiceState
+	junctionState
+	finalState
+	entryPointState
+	exitPointState
+)
+
 // StateInstance defines state entry/exit actions and relationships with
 // other states in the machine hierarchy.
 type StateInstance struct {
-	Name         State
-	initialState State
-	parent       *StateInstance
-	transitions  map[Event]*Transition
-	entryActions []ActionFunc
-	exitActions  []ActionFunc
+	Name                State
+	kind                stateKind
+	initialState        State
+	parent              *StateInstance
+	children            []*StateInstance
+	parallel            bool
+	order               int
+	transitions         map[Event][]*Transition
+	entryActions        []ActionFunc
+	exitActions         []ActionFunc
+	deferred            []Event
+	timeEvents          []Event
+	exitCompensations   []ActionFunc
+	entryCompensations  []ActionFunc
+	contextEntryActions []ContextActionFunc
+	contextExitActions  []ContextActionFunc
+	submachine          *Definition
+	frozen              bool
 }
 
 // NewState creates a new state with the hierarchial state machine.
@@ -36,47 +74,215 @@ func (hsm *Base) NewState(name State) *StateInstance {
 	if hsm.runState == INITIALIZING {
 		state = &StateInstance{}
 		state.Name = name
-		state.transitions = make(map[Event]*Transition)
+		state.transitions = make(map[Event][]*Transition)
 		// Set current state to first state added
 		if len(hsm.states) == 0 {
 			hsm.CurrentState = state.Name
 		}
+		if _, ok := hsm.states[state.Name]; ok {
+			hsm.redefined = append(hsm.redefined, state.Name)
+		}
 		hsm.states[state.Name] = state
 	}
 	return state
 }
 
+// NewShallowHistory creates a shallow history pseudostate.  Once added as a
+// child of a composite state, a transition targeting the pseudostate resumes
+// the composite's last active child, entering that child's default states.
+// The composite's default state is used if it has not yet been active.
+func (hsm *Base) NewShallowHistory(name State) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.kind = shallowHistoryState
+	}
+	return state
+}
+
+// NewDeepHistory creates a deep history pseudostate.  Once added as a child
+// of a composite state, a transition targeting the pseudostate resumes the
+// composite's last active leaf state, restoring the full sub-configuration.
+// The composite's default state is used if it has not yet been active.
+func (hsm *Base) NewDeepHistory(name State) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.kind = deepHistoryState
+	}
+	return state
+}
+
+// NewChoice creates a choice pseudostate for dynamic branching.  Its
+// outgoing branches are transitions added with AddTransitions, leaving On
+// empty.  A transition targeting the choice runs its exit and transition
+// actions before the branch guards are evaluated, in declaration order,
+// with the event param.  One branch must be allowed, so a choice usually
+// has an Else branch.
+func (hsm *Base) NewChoice(name State) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.kind = choiceState
+	}
+	return state
+}
+
+// NewJunction creates a junction pseudostate that statically chains
+// transition segments.  Its outgoing branches are transitions added with
+// AddTransitions, leaving On empty.  The branch guards are evaluated before
+// any action runs, when the transition targeting the junction is selected;
+// the transition is only taken if a branch is allowed.  The exit actions,
+// the actions of every segment and the entry actions then run as for a
+// single transition.
+func (hsm *Base) NewJunction(name State) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.kind = junctionState
+	}
+	return state
+}
+
+// NewFinalState creates a final state.  Once added as a child of a
+// composite state, entering the final state completes the composite and
+// fires its completion event: the composite's transitions added with an
+// empty On event are then taken.  An orthogonal state completes when every
+// one of its regions has completed.
+func (hsm *Base) NewFinalState(name State) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.kind = finalState
+	}
+	return state
+}
+
+// NewEntryPoint creates an entry point pseudostate.  Once added as a child
+// of a composite state, external transitions target the entry point rather
+// than one of the composite's sub-states, keeping the composite
+// encapsulated.  Its outgoing branch, a transition added with
+// AddTransitions leaving On empty, routes to the sub-state entered.  As for
+// a junction, branches are chained to the transition targeting the entry
+// point when it is selected, the first allowed by its guard being taken.
+// As in UML, the branch's action runs after the composite's entry actions.
+func (hsm *Base) NewEntryPoint(name State) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.kind = entryPointState
+	}
+	return state
+}
+
+// NewExitPoint creates an exit point pseudostate.  Once added as a child of
+// a composite state, its sub-states leave the composite through a
+// transition targeting the exit point.  Its outgoing branch, a transition
+// added with AddTransitions leaving On empty, targets a state outside the
+// composite.  Branches are chained as for an entry point.
+func (hsm *Base) NewExitPoint(name State) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.kind = exitPointState
+	}
+	return state
+}
+
+// isConnection returns true if the state is a pseudostate whose branches are
+// chained to the transition targeting it: a junction, entry or exit point.
+func (state *StateInstance) isConnection() bool {
+	return state.kind == junctionState || state.kind == entryPointState ||
+		state.kind == exitPointState
+}
+
 // AddTransitions adds/defines the allowed transitions for a given state.
+// Transitions for an event already defined are added after the existing
+// ones.  Transitions on time events, see After and Every, are armed when
+// the state is entered.
 func (state *StateInstance) AddTransitions(trans []Transition) {
-	if state != nil {
-		for _, tran := range trans {
-			state.transitions[tran.On] = &tran
+	if state.configurable() {
+		for i := range trans {
+			tran := trans[i]
+			if _, _, ok := parseTimeEvent(tran.On); ok &&
+				len(state.transitions[tran.On]) == 0 {
+				state.timeEvents = append(state.timeEvents, tran.On)
+			}
+			state.transitions[tran.On] = append(state.transitions[tran.On], &tran)
 		}
 	}
 }
 
 // AddChildren adds child state instances to the current state definition.
 func (state *StateInstance) AddChildren(children ...*StateInstance) {
-	if state != nil {
+	if state.configurable() {
 		for _, child := range children {
-			if state.initialState == "" {
+			if child.frozen {
+				continue
+			}
+			// Pseudostates and final states are never the default state.
+			if state.initialState == "" && child.kind == regularState {
 				state.initialState = child.Name
 			}
 			child.parent = state
+			state.children = append(state.children, child)
+		}
+	}
+}
+
+// AddRegions adds orthogonal regions to the current state definition,
+// making it an orthogonal (concurrent) composite state.  Each region is a
+// composite state with its own default child; entering the state enters
+// every region, and events are dispatched to each active region.
+func (state *StateInstance) AddRegions(regions ...*StateInstance) {
+	if state.configurable() {
+		state.parallel = true
+		state.AddChildren(regions...)
+	}
+}
+
+// configurable returns true if the state can still be configured: it
+// exists and it is not shared by a compiled Definition.
+func (state *StateInstance) configurable() bool {
+	return state != nil && !state.frozen
+}
+
+// contains returns true if the given state is this state or one of its
+// descendants.
+func (state *StateInstance) contains(other *StateInstance) bool {
+	for ; other != nil; other = other.parent {
+		if other == state {
+			return true
 		}
 	}
+	return false
+}
+
+// setDocumentOrder numbers this state and its descendants in depth-first,
+// declaration order, starting at order.  The order determines the sequence
+// in which orthogonal regions are entered, exited and handle events.  The
+// next unused order number is returned.
+func (state *StateInstance) setDocumentOrder(order int) int {
+	state.order = order
+	order++
+	for _, child := range state.children {
+		order = child.setDocumentOrder(order)
+	}
+	return order
+}
+
+// AddDeferredEvents defines one or more events deferred by a given state.
+// A deferred event that no active state handles while the state is active
+// is kept, and dispatched again once no active state defers it.
+func (state *StateInstance) AddDeferredEvents(events ...Event) {
+	if state.configurable() {
+		state.deferred = append(state.deferred, events...)
+	}
 }
 
 // AddEntryActions defines one or more entry actions for a given state.
 func (state *StateInstance) AddEntryActions(actions ...ActionFunc) {
-	if state != nil {
+	if state.configurable() {
 		state.entryActions = append(state.entryActions, actions...)
 	}
 }
 
 // AddExitActions defines one or more exit actions for a given state.
 func (state *StateInstance) AddExitActions(actions ...ActionFunc) {
-	if state != nil {
+	if state.configurable() {
 		state.exitActions = append(state.exitActions, actions...)
 	}
 }
@@ -0,0 +1,160 @@
+package hsm
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ErrSnapshotNotFound is returned by stores with no snapshot saved for a
+// machine ID.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Store saves and loads machine snapshots by machine ID.
+type Store interface {
+	Save(id string, data []byte) error
+	Load(id string) ([]byte, error)
+}
+
+// MemoryStore keeps snapshots in memory.  It is safe for concurrent use.
+type MemoryStore struct {
+	snapshots map[string][]byte
+	sync.Mutex
+}
+
+// NewMemoryStore creates an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{snapshots: make(map[string][]byte)}
+}
+
+// Save keeps a copy of the snapshot.
+func (store *MemoryStore) Save(id string, data []byte) error {
+	store.Lock()
+	defer store.Unlock()
+	store.snapshots[id] = append([]byte{}, data...)
+	return nil
+}
+
+// Load returns a copy of the snapshot.
+func (store *MemoryStore) Load(id string) ([]byte, error) {
+	store.Lock()
+	defer store.Unlock()
+	data, ok := store.snapshots[id]
+	if !ok {
+		return nil, ErrSnapshotNotFound
+	}
+	return append([]byte{}, data...), nil
+}
+
+// FileStore keeps each snapshot in a file of its directory, named after
+// the escaped machine ID.  Snapshots are written to a temporary file then
+// renamed, so a crash never leaves a partially written snapshot.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a file store keeping snapshots in the directory,
+// which must exist.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (store *FileStore) path(id string) string {
+	return filepath.Join(store.dir, url.PathEscape(id)+".snapshot")
+}
+
+// Save writes the snapshot file.
+func (store *FileStore) Save(id string, data []byte) error {
+	tmp, err := ioutil.TempFile(store.dir, ".snapshot-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), store.path(id))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Load reads the snapshot file.
+func (store *FileStore) Load(id string) ([]byte, error) {
+	data, err := ioutil.ReadFile(store.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSnapshotNotFound
+	}
+	return data, err
+}
+
+// EnableCheckpoints saves a snapshot of the machine to the store, under
+// the machine ID, after every run to completion step completed while the
+// machine is on, and once it is turned off.  A failed checkpoint is logged
+// and returned by Inject, but the event, and the events posted or released
+// by it, are nonetheless dispatched.
+func (hsm *Base) EnableCheckpoints(store Store, id string) {
+	hsm.store = store
+	hsm.storeID = id
+}
+
+// DisableCheckpoints stops saving snapshots after run to completion steps.
+func (hsm *Base) DisableCheckpoints() {
+	hsm.store = nil
+}
+
+// Checkpoint saves a snapshot of the machine to the store set with
+// EnableCheckpoints.
+func (hsm *Base) Checkpoint() error {
+	hsm.Lock()
+	defer hsm.Unlock()
+	return hsm.checkpoint()
+}
+
+// checkpoint implements Checkpoint.  The caller must hold the RTC lock.
+func (hsm *Base) checkpoint() error {
+	if hsm.store == nil {
+		return fmt.Errorf("cannot checkpoint hsm %s; it has no store",
+			hsm.Name)
+	}
+	data, err := hsm.snapshot()
+	if err == nil {
+		err = hsm.store.Save(hsm.storeID, data)
+	}
+	if err != nil {
+		err = fmt.Errorf("checkpoint of hsm %s failed: %v", hsm.Name, err)
+		hsm.log.Error(err)
+	}
+	return err
+}
+
+// checkpointStep saves a checkpoint at the end of a run to completion step,
+// once its deferred events and completion events have been dispatched, if
+// checkpoints are enabled and the machine is on and not replaying.  The
+// caller must hold the RTC lock.
+func (hsm *Base) checkpointStep() error {
+	if hsm.store == nil || hsm.runState != ON || hsm.replaying {
+		return nil
+	}
+	return hsm.checkpoint()
+}
+
+// RestoreFrom restores the snapshot saved in the store under the machine
+// ID, see Restore.
+func (hsm *Base) RestoreFrom(store Store, id string) error {
+	data, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	return hsm.Restore(data)
+}
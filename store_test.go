@@ -0,0 +1,95 @@
+package hsm_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// countingStore counts the snapshots saved to a memory store, failing to
+// save them while full.
+type countingStore struct {
+	*hsm.MemoryStore
+	saves int
+	full  bool
+}
+
+func (store *countingStore) Save(id string, data []byte) error {
+	store.saves++
+	if store.full {
+		return errors.New("store full")
+	}
+	return store.MemoryStore.Save(id, data)
+}
+
+func TestStores(t *testing.T) {
+
+	Convey("CASE: Persistence Stores and Checkpoints", t, func() {
+		tr := &trace{}
+		sm := newPseudostatesHSM(tr)
+
+		Convey("1. Transitions are checkpointed to the store\n", func() {
+			store := hsm.NewMemoryStore()
+			sm.EnableCheckpoints(store, "router-1")
+			sm.On()
+			sm.Inject(evRoute, "a")
+
+			restored := newPseudostatesHSM(tr)
+			So(restored.RestoreFrom(store, "router-1"), ShouldBeNil)
+			So(restored.CurrentState, ShouldEqual, stRouteA)
+		})
+
+		Convey("2. The file store survives a new store instance\n", func() {
+			dir, err := ioutil.TempDir("", "hsm")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			sm.EnableCheckpoints(hsm.NewFileStore(dir), "router/2")
+			sm.On()
+			sm.Inject(evRoute, "b")
+			So(sm.Off(), ShouldBeNil)
+
+			restored := newPseudostatesHSM(tr)
+			So(restored.RestoreFrom(hsm.NewFileStore(dir), "router/2"), ShouldBeNil)
+			So(restored.On(), ShouldBeNil)
+			So(restored.CurrentState, ShouldEqual, stReady)
+		})
+
+		Convey("3. A step is checkpointed once, after its completions\n", func() {
+			store := &countingStore{MemoryStore: hsm.NewMemoryStore()}
+			final := newFinalHSM(tr)
+			final.EnableCheckpoints(store, "workflow-1")
+			final.On()
+			final.Inject(evNext, nil)
+			store.saves = 0
+			So(final.Inject(evNext, nil), ShouldBeNil)
+			So(final.CurrentState, ShouldEqual, stFinished)
+			So(store.saves, ShouldEqual, 1)
+
+			restored := newFinalHSM(tr)
+			So(restored.RestoreFrom(store, "workflow-1"), ShouldBeNil)
+			So(restored.CurrentState, ShouldEqual, stFinished)
+		})
+
+		Convey("4. A failed checkpoint does not abandon the dispatch\n", func() {
+			store := &countingStore{MemoryStore: hsm.NewMemoryStore(), full: true}
+			final := newFinalHSM(tr)
+			final.EnableCheckpoints(store, "workflow-2")
+			final.On()
+			final.Inject(evNext, nil)
+			err := final.Inject(evNext, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "store full")
+			So(final.CurrentState, ShouldEqual, stFinished)
+		})
+
+		Convey("5. Missing snapshots are reported\n", func() {
+			_, err := hsm.NewMemoryStore().Load("none")
+			So(err, ShouldEqual, hsm.ErrSnapshotNotFound)
+			So(sm.RestoreFrom(hsm.NewMemoryStore(), "none"), ShouldNotBeNil)
+		})
+	})
+}
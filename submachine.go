@@ -0,0 +1,256 @@
+package hsm
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrUnhandledEvent is wrapped by the error returned when no active state
+// handles an injected event.
+var ErrUnhandledEvent = errors.New("unhandled event/transition")
+
+// NewSubmachine creates a sub-machine state, a leaf state embedding a
+// separately defined machine compiled into a Definition.  Entering the state
+// starts a new instance of the definition, after the state's entry actions,
+// and exiting it turns the instance off, before the state's exit actions.
+// Events are dispatched to the sub-machine first; the events it does not
+// handle bubble up to the sub-machine state and its ancestors.  When the
+// sub-machine completes, entering a final state child of its top state, the
+// completion event of the sub-machine state fires: its transitions added
+// with an empty On event are taken.  When a time event of the sub-machine
+// completes it, or is not handled by the sub-machine, this is posted to the
+// owning machine, see Post: once dispatched, the completion event fires or
+// the time event bubbles up from the sub-machine state.  CanInject
+// considers the sub-machine, while Preview returns an error for the events
+// it handles.
+func (hsm *Base) NewSubmachine(name State, def *Definition) *StateInstance {
+	state := hsm.NewState(name)
+	if state != nil {
+		state.submachine = def
+	}
+	return state
+}
+
+// Submachine returns the running instance of an active sub-machine state,
+// or nil if the state is not an active sub-machine state.
+func (hsm *Base) Submachine(name State) *Instance {
+	hsm.Lock()
+	defer hsm.Unlock()
+	state, ok := hsm.states[name]
+	if !ok {
+		return nil
+	}
+	return hsm.submachines[state]
+}
+
+// startSubmachine starts a new instance of the sub-machine of an entered
+// state, if any.
+func (hsm *Base) startSubmachine(state *StateInstance) {
+	hsm.resumeSubmachine(state, nil)
+}
+
+// resumeSubmachine starts a new instance of the sub-machine of an active
+// state, if any, restoring the snapshot of a previous instance without
+// running any action if one is given.  If the snapshot cannot be restored,
+// the instance is started as if the state was entered and the error is
+// returned.
+func (hsm *Base) resumeSubmachine(state *StateInstance, data []byte) error {
+	if state.submachine == nil {
+		return nil
+	}
+	hsm.stopSubmachine(state)
+	sub := state.submachine.NewInstance(hsm.Name+"/"+string(state.Name), nil)
+	sub.owner = hsm
+	sub.suppressActions = hsm.suppressActions
+	if hsm.submachines == nil {
+		hsm.submachines = make(map[*StateInstance]*Instance)
+	}
+	hsm.submachines[state] = sub
+	var err error
+	if data != nil {
+		err = sub.Restore(data)
+	}
+	if data == nil || err != nil {
+		sub.On()
+	}
+	if sub.takeCompletion() {
+		hsm.completions = append(hsm.completions, state)
+	}
+	return err
+}
+
+// stopSubmachine turns off the running sub-machine of an exited state, if
+// any.
+func (hsm *Base) stopSubmachine(state *StateInstance) {
+	sub, ok := hsm.submachines[state]
+	if !ok {
+		return
+	}
+	delete(hsm.submachines, state)
+	sub.Off()
+}
+
+// suspendSubmachine turns off the running sub-machine of a state exited by
+// the transaction, if any, saving its snapshot so that a rollback can
+// resume it.
+func (hsm *Base) suspendSubmachine(tx *transaction, state *StateInstance) {
+	sub, ok := hsm.submachines[state]
+	if !ok {
+		return
+	}
+	if data, err := sub.Snapshot(); err == nil {
+		if tx.submachines == nil {
+			tx.submachines = make(map[*StateInstance][]byte)
+		}
+		tx.submachines[state] = data
+	}
+	hsm.stopSubmachine(state)
+}
+
+// restoreSubmachines matches the running sub-machines to the active
+// configuration once a transition has stopped: the sub-machines of the
+// states left are turned off, and those the transition turned off are
+// resumed if their state is active again.
+func (hsm *Base) restoreSubmachines(tx *transaction) {
+	active := hsm.activeStates()
+	for state := range hsm.submachines {
+		if !containsState(active, state) {
+			hsm.stopSubmachine(state)
+		}
+	}
+	for _, leaf := range hsm.leaves {
+		data, suspended := tx.submachines[leaf]
+		if _, running := hsm.submachines[leaf]; suspended || !running {
+			if err := hsm.resumeSubmachine(leaf, data); err != nil {
+				hsm.log.Error(err)
+			}
+		}
+	}
+}
+
+// dispatchSubmachines dispatches an event to the sub-machines of the active
+// leaf states and returns the leaves whose sub-machine handled it.  The
+// completion events of the sub-machines that completed are queued.
+func (hsm *Base) dispatchSubmachines(event Event, param interface{}) (
+	[]*StateInstance, error) {
+
+	consumed := []*StateInstance{}
+	if hsm.runState != ON || event == hsmInitEvent || event == hsmExitEvent {
+		return consumed, nil
+	}
+	for _, leaf := range hsm.leaves {
+		sub, ok := hsm.submachines[leaf]
+		if !ok {
+			continue
+		}
+		handled, err := sub.dispatchFromOwner(hsm.context(), event, param)
+		if sub.takeCompletion() {
+			hsm.completions = append(hsm.completions, leaf)
+		}
+		if err != nil {
+			return consumed, err
+		}
+		if handled {
+			consumed = append(consumed, leaf)
+		}
+	}
+	return consumed, nil
+}
+
+// dispatchFromOwner dispatches an event of the owning machine to the
+// sub-machine, returning false if the sub-machine does not handle it.
+func (hsm *Base) dispatchFromOwner(ctx context.Context, event Event,
+	param interface{}) (bool, error) {
+
+	hsm.Lock()
+	defer hsm.Unlock()
+	if hsm.runState != ON {
+		return false, nil
+	}
+	hsm.ctx = ctx
+	err := hsm.dispatch(event, param)
+	hsm.dispatchDeferred()
+	hsm.ctx = nil
+	hsm.dispatchQueued()
+	if errors.Is(err, ErrUnhandledEvent) {
+		return false, nil
+	}
+	return true, err
+}
+
+// submachineReport reports to the owning machine that a sub-machine
+// completed or did not handle one of its time events.
+type submachineReport struct {
+	sub   *Base
+	event Event
+}
+
+// report posts to the owning machine, if any, the completion of the
+// sub-machine and the time event it did not handle, if any, once the run
+// to completion step of the time event is over.  The caller must hold the
+// RTC lock.
+func (hsm *Base) report(unhandled Event) {
+	if hsm.owner == nil || (!hsm.completed && unhandled == "") {
+		return
+	}
+	owner := hsm.owner
+	owner.queueLock.Lock()
+	owner.reports = append(owner.reports, submachineReport{hsm, unhandled})
+	owner.queueLock.Unlock()
+	owner.post(hsmSubmachineEvent, nil)
+}
+
+// dispatchReports dispatches the reports of the sub-machines still running:
+// the completion events of those that completed are queued, and the time
+// events they did not handle bubble up from their sub-machine state.  The
+// caller must hold the RTC lock.
+func (hsm *Base) dispatchReports() error {
+	hsm.queueLock.Lock()
+	reports := hsm.reports
+	hsm.reports = nil
+	hsm.queueLock.Unlock()
+
+	for _, report := range reports {
+		var leaf *StateInstance
+		for state, sub := range hsm.submachines {
+			if &sub.Base == report.sub {
+				leaf = state
+			}
+		}
+		if leaf == nil {
+			continue
+		}
+		if report.sub.takeCompletion() {
+			hsm.completions = append(hsm.completions, leaf)
+		}
+		if report.event == "" {
+			continue
+		}
+		hsm.notify(Observation{Kind: EventReceived, Event: report.event,
+			State: leaf.Name}, time.Time{})
+		for state := leaf; state != hsm.topState; state = state.parent {
+			segments, err := hsm.selectTransition(state, report.event, nil)
+			if err != nil {
+				return err
+			}
+			if segments != nil {
+				err = hsm.applyTransition(segments, nil, state)
+				if err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+	return hsm.dispatchCompletions()
+}
+
+// takeCompletion returns true, once, if the sub-machine has completed.
+func (hsm *Base) takeCompletion() bool {
+	hsm.Lock()
+	defer hsm.Unlock()
+	completed := hsm.completed
+	hsm.completed = false
+	return completed
+}
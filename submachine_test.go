@@ -0,0 +1,314 @@
+package hsm_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evBuy       hsm.Event = "buy"
+	evAbandon   hsm.Event = "abandon"
+	evPick      hsm.Event = "pick"
+	evSubmit    hsm.Event = "submit"
+	stShop      hsm.State = "shop"
+	stBrowsing  hsm.State = "browsing"
+	stOrdering  hsm.State = "ordering"
+	stShipped   hsm.State = "shipped"
+	stOrder     hsm.State = "order"
+	stBasket    hsm.State = "basket"
+	stCheckout  hsm.State = "checkout"
+	stOrderDone hsm.State = "orderDone"
+
+	evLift         hsm.Event = "lift"
+	evDial         hsm.Event = "dial"
+	evHangUp       hsm.Event = "hangUp"
+	stCall         hsm.State = "call"
+	stRinging      hsm.State = "ringing"
+	stHungUp       hsm.State = "hungUp"
+	stPhone        hsm.State = "phone"
+	stOnHook       hsm.State = "onHook"
+	stLine         hsm.State = "line"
+	stDialTone     hsm.State = "dialTone"
+	stInCall       hsm.State = "inCall"
+	stDisconnected hsm.State = "disconnected"
+)
+
+// newOrderDefinition compiles an order that is checked out once an item is
+// picked and completes when submitted.
+func newOrderDefinition(tr *trace) *hsm.Definition {
+	sm := &hsm.Base{}
+	sm.Configure("orderHSM")
+
+	order := sm.NewState(stOrder)
+	basket := sm.NewState(stBasket)
+	basket.AddEntryActions(tr.entry(string(stBasket)))
+	basket.AddExitActions(tr.exit(string(stBasket)))
+	basket.AddTransitions([]hsm.Transition{
+		{On: evPick, NewState: stCheckout}})
+	checkout := sm.NewState(stCheckout)
+	checkout.AddTransitions([]hsm.Transition{
+		{On: evSubmit, NewState: stOrderDone}})
+	done := sm.NewFinalState(stOrderDone)
+
+	order.AddChildren(basket, checkout, done)
+
+	sm.Finalize()
+	def, _ := sm.Definition()
+	return def
+}
+
+// newShopHSM builds a shop whose ordering state embeds the order
+// definition.  The entry action of shipped fails if failing names it.
+func newShopHSM(tr *trace, def *hsm.Definition, failing *string) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("shopHSM")
+
+	shop := sm.NewState(stShop)
+	browsing := sm.NewState(stBrowsing)
+	browsing.AddTransitions([]hsm.Transition{
+		{On: evBuy, NewState: stOrdering}})
+	ordering := sm.NewSubmachine(stOrdering, def)
+	ordering.AddEntryActions(tr.entry(string(stOrdering)))
+	ordering.AddExitActions(tr.exit(string(stOrdering)))
+	ordering.AddTransitions([]hsm.Transition{
+		{On: evAbandon, NewState: stBrowsing},
+		{NewState: stShipped},
+	})
+	shipped := sm.NewState(stShipped)
+	shipped.AddEntryActions(tr.fail(string(stShipped), failing))
+
+	shop.AddChildren(browsing, ordering, shipped)
+
+	sm.Finalize()
+	return sm
+}
+
+// newPhoneHSM builds a phone whose in-call state embeds a call that hangs
+// up after a minute of ringing or on the hangUp event, and whose line is
+// disconnected after 30s if answered allows it.  The call does not handle
+// its own 30s time event.
+func newPhoneHSM(clock hsm.Clock, answered *bool) *hsm.Base {
+	call := &hsm.Base{}
+	call.Configure("callHSM")
+	call.SetClock(clock)
+	top := call.NewState(stCall)
+	ringing := call.NewState(stRinging)
+	ringing.AddTransitions([]hsm.Transition{
+		{On: hsm.After(time.Minute), NewState: stHungUp},
+		{On: evHangUp, NewState: stHungUp},
+		{On: hsm.After(30 * time.Second),
+			Guard: func(param interface{}) (bool, error) {
+				return false, nil
+			}},
+	})
+	hungUp := call.NewFinalState(stHungUp)
+	top.AddChildren(ringing, hungUp)
+	call.Finalize()
+	def, _ := call.Definition()
+
+	sm := &hsm.Base{}
+	sm.Configure("phoneHSM")
+	sm.SetClock(clock)
+	phone := sm.NewState(stPhone)
+	onHook := sm.NewState(stOnHook)
+	onHook.AddTransitions([]hsm.Transition{
+		{On: evLift, NewState: stLine}})
+	line := sm.NewState(stLine)
+	line.AddTransitions([]hsm.Transition{
+		{On: hsm.After(30 * time.Second), NewState: stDisconnected,
+			Guard: func(param interface{}) (bool, error) {
+				return *answered, nil
+			}},
+	})
+	dialTone := sm.NewState(stDialTone)
+	dialTone.AddTransitions([]hsm.Transition{
+		{On: evDial, NewState: stInCall}})
+	inCall := sm.NewSubmachine(stInCall, def)
+	inCall.AddTransitions([]hsm.Transition{{NewState: stDisconnected}})
+	disconnected := sm.NewState(stDisconnected)
+	phone.AddChildren(onHook, line, disconnected)
+	line.AddChildren(dialTone, inCall)
+	sm.Finalize()
+	return sm
+}
+
+// awaitState returns the state of the first transition completed by the
+// run loop of the machine, or an empty state after a second.
+func awaitState(sm *hsm.Base, completed chan hsm.State) hsm.State {
+	var state hsm.State
+	select {
+	case state = <-completed:
+	case <-time.After(time.Second):
+	}
+	sm.Stop()
+	return state
+}
+
+func TestSubmachines(t *testing.T) {
+
+	Convey("CASE: Sub-machine States", t, func() {
+		tr := &trace{}
+		failing := ""
+		sm := newShopHSM(tr, newOrderDefinition(tr), &failing)
+		sm.On()
+
+		Convey("1. Entering a sub-machine state starts the sub-machine\n", func() {
+			So(sm.Submachine(stOrdering), ShouldBeNil)
+			So(sm.Inject(evBuy, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stOrdering)
+			So(sm.Submachine(stOrdering).CurrentState, ShouldEqual, stBasket)
+			So(*tr, ShouldResemble, trace{"ordering entry", "basket entry"})
+		})
+
+		Convey("2. Events are dispatched to the sub-machine first\n", func() {
+			sm.Inject(evBuy, nil)
+			So(sm.Inject(evPick, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stOrdering)
+			So(sm.Submachine(stOrdering).CurrentState, ShouldEqual, stCheckout)
+		})
+
+		Convey("3. Unhandled events bubble up to the sub-machine state\n", func() {
+			sm.Inject(evBuy, nil)
+			*tr = nil
+			So(sm.Inject(evAbandon, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stBrowsing)
+			So(sm.Submachine(stOrdering), ShouldBeNil)
+			So(*tr, ShouldResemble, trace{"basket exit", "ordering exit"})
+		})
+
+		Convey("4. Completing the sub-machine fires the completion event\n", func() {
+			sm.Inject(evBuy, nil)
+			sm.Inject(evPick, nil)
+			So(sm.Inject(evSubmit, nil), ShouldBeNil)
+			So(sm.CurrentState, ShouldEqual, stShipped)
+			So(sm.Submachine(stOrdering), ShouldBeNil)
+		})
+
+		Convey("5. Events neither machine handles remain unhandled\n", func() {
+			sm.Inject(evBuy, nil)
+			err := sm.Inject(evSubmit, nil)
+			So(err, ShouldNotBeNil)
+			So(errors.Is(err, hsm.ErrUnhandledEvent), ShouldBeTrue)
+			So(sm.CurrentState, ShouldEqual, stOrdering)
+		})
+
+		Convey("6. Turning the machine off turns the sub-machine off\n", func() {
+			sm.Inject(evBuy, nil)
+			sub := sm.Submachine(stOrdering)
+			*tr = nil
+			So(sm.Off(), ShouldBeNil)
+			So(sub.RunLevel(), ShouldEqual, hsm.OFF)
+			So(*tr, ShouldResemble, trace{"basket exit", "ordering exit"})
+		})
+
+		Convey("7. Restoring a snapshot restores the sub-machine\n", func() {
+			sm.Inject(evBuy, nil)
+			sm.Inject(evPick, nil)
+			data, err := sm.Snapshot()
+			So(err, ShouldBeNil)
+			*tr = nil
+			restored := newShopHSM(tr, newOrderDefinition(tr), &failing)
+			So(restored.Restore(data), ShouldBeNil)
+			So(restored.Submachine(stOrdering), ShouldNotBeNil)
+			So(restored.Submachine(stOrdering).CurrentState, ShouldEqual,
+				stCheckout)
+			So(*tr, ShouldBeEmpty)
+			So(restored.Inject(evSubmit, nil), ShouldBeNil)
+			So(restored.CurrentState, ShouldEqual, stShipped)
+		})
+
+		Convey("8. A stopped transition resumes the sub-machine it left\n", func() {
+			failing = string(stShipped)
+			sm.Inject(evBuy, nil)
+			So(sm.Inject(evPick, nil), ShouldBeNil)
+			So(sm.Inject(evSubmit, nil), ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stOrdering)
+			So(sm.Submachine(stOrdering), ShouldNotBeNil)
+			So(sm.Submachine(stOrdering).CurrentState, ShouldEqual,
+				stOrderDone)
+		})
+
+		Convey("9. A rollback resumes the sub-machine it left\n", func() {
+			failing = string(stShipped)
+			sm.SetFailurePolicy(hsm.CompensateOnFailure)
+			sm.Inject(evBuy, nil)
+			sm.Inject(evPick, nil)
+			*tr = nil
+			So(sm.Inject(evSubmit, nil), ShouldNotBeNil)
+			So(sm.CurrentState, ShouldEqual, stOrdering)
+			So(sm.Submachine(stOrdering).CurrentState, ShouldEqual,
+				stOrderDone)
+			So(*tr, ShouldResemble, trace{"ordering exit", "shipped action"})
+		})
+	})
+
+	Convey("CASE: Sub-machine Time Events", t, func() {
+		clock := hsm.NewFakeClock(time.Unix(0, 0))
+		answered := false
+		sm := newPhoneHSM(clock, &answered)
+		sm.On()
+		sm.Inject(evLift, nil)
+		completed := make(chan hsm.State, 1)
+		sm.AddListener(func(observation hsm.Observation) {
+			if observation.Kind == hsm.TransitionCompleted {
+				completed <- observation.State
+			}
+		})
+
+		Convey("1. A sub-machine completed by a time event is reported\n", func() {
+			sm.Inject(evDial, nil)
+			<-completed
+			So(sm.Start(), ShouldBeNil)
+			clock.Advance(time.Minute)
+			So(awaitState(sm, completed), ShouldEqual, stDisconnected)
+		})
+
+		Convey("2. Unhandled time events bubble up from the sub-machine\n", func() {
+			clock.Advance(10 * time.Second)
+			sm.Inject(evDial, nil)
+			<-completed
+			So(sm.Start(), ShouldBeNil)
+			clock.Advance(25 * time.Second)
+			So(sm.IsIn(stInCall), ShouldBeTrue)
+			answered = true
+			clock.Advance(10 * time.Second)
+			So(awaitState(sm, completed), ShouldEqual, stDisconnected)
+		})
+
+		Convey("3. Dry runs consider the events a sub-machine handles\n", func() {
+			sm.Inject(evDial, nil)
+			<-completed
+			ok, err := sm.CanInject(evHangUp, nil)
+			So(err, ShouldBeNil)
+			So(ok, ShouldBeTrue)
+			ok, _ = sm.CanInject(evLift, nil)
+			So(ok, ShouldBeFalse)
+			_, err = sm.Preview(evHangUp, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "sub-machine of inCall")
+		})
+
+		Convey("4. Sub-machine states cannot be exported to SCXML\n", func() {
+			_, err := sm.ExportSCXML(nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "sub-machine state inCall")
+		})
+	})
+
+	Convey("CASE: Sub-machine Validation", t, func() {
+		sm := &hsm.Base{}
+		sm.Configure("invalidShopHSM")
+		shop := sm.NewState(stShop)
+		ordering := sm.NewSubmachine(stOrdering, newOrderDefinition(&trace{}))
+		ordering.AddChildren(sm.NewState(stBasket))
+		shop.AddChildren(ordering)
+
+		Convey("1. Sub-machine states cannot have children\n", func() {
+			So(sm.Validate().Errors(), ShouldHaveLength, 1)
+		})
+	})
+}
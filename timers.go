@@ -0,0 +1,176 @@
+package hsm
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	afterPrefix = "after("
+	everyPrefix = "every("
+)
+
+// After returns the time event fired once the given duration has elapsed
+// since the state defining a transition on the event was entered.  The
+// duration must be positive.
+func After(d time.Duration) Event {
+	return Event(afterPrefix + d.String() + ")")
+}
+
+// Every returns the time event fired each time the given duration elapses
+// while the state defining a transition on the event remains active.  The
+// duration must be positive.
+func Every(d time.Duration) Event {
+	return Event(everyPrefix + d.String() + ")")
+}
+
+// parseTimeEvent returns the duration of a time event and whether it is
+// periodic.  ok is false if the event is not a time event or if its
+// duration is not positive.
+func parseTimeEvent(event Event) (d time.Duration, periodic bool, ok bool) {
+	name := string(event)
+	if !strings.HasSuffix(name, ")") {
+		return 0, false, false
+	}
+	switch {
+	case strings.HasPrefix(name, afterPrefix):
+		name = strings.TrimPrefix(name, afterPrefix)
+	case strings.HasPrefix(name, everyPrefix):
+		name = strings.TrimPrefix(name, everyPrefix)
+		periodic = true
+	default:
+		return 0, false, false
+	}
+	d, err := time.ParseDuration(strings.TrimSuffix(name, ")"))
+	if err != nil || d <= 0 {
+		return 0, false, false
+	}
+	return d, periodic, true
+}
+
+// isTimeEventName returns true if the event is named as a time event,
+// whether its duration is valid or not.
+func isTimeEventName(event Event) bool {
+	name := string(event)
+	return strings.HasSuffix(name, ")") &&
+		(strings.HasPrefix(name, afterPrefix) ||
+			strings.HasPrefix(name, everyPrefix))
+}
+
+// armedTimer is a timer started for a time event of an active state, due
+// at the given time.
+type armedTimer struct {
+	event Event
+	timer Timer
+	due   time.Time
+}
+
+// SetClock replaces the clock used for time events.  It must be called
+// before the state machine is turned on.
+func (hsm *Base) SetClock(clock Clock) {
+	hsm.clock = clock
+}
+
+// armTimers starts a timer for each time event of a state being entered.
+func (hsm *Base) armTimers(state *StateInstance) {
+	for _, event := range state.timeEvents {
+		hsm.armTimer(state, event)
+	}
+}
+
+func (hsm *Base) armTimer(state *StateInstance, event Event) {
+	d, _, _ := parseTimeEvent(event)
+	hsm.armTimerFor(state, event, d)
+}
+
+// armTimerFor starts a timer for a time event of a state, due after d.
+func (hsm *Base) armTimerFor(state *StateInstance, event Event,
+	d time.Duration) {
+
+	if hsm.replaying {
+		return
+	}
+	armed := &armedTimer{event: event, due: hsm.clock.Now().Add(d)}
+	armed.timer = hsm.clock.AfterFunc(d, func() {
+		hsm.fireTimer(state, armed)
+	})
+	hsm.timers[state] = append(hsm.timers[state], armed)
+}
+
+// cancelTimers stops the timers of a state being exited.
+func (hsm *Base) cancelTimers(state *StateInstance) {
+	for _, armed := range hsm.timers[state] {
+		armed.timer.Stop()
+	}
+	delete(hsm.timers, state)
+}
+
+// disarm removes a timer from the timers of the state, returning false if
+// it was cancelled.
+func (hsm *Base) disarm(state *StateInstance, armed *armedTimer) bool {
+	timers := hsm.timers[state]
+	for i, t := range timers {
+		if t == armed {
+			hsm.timers[state] = append(timers[:i:i], timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fireTimer takes the transition of the state for the time event of an
+// expired timer, then re-arms the timer of a periodic time event.  The time
+// event is only handled by the state that armed it.
+func (hsm *Base) fireTimer(state *StateInstance, armed *armedTimer) {
+	hsm.Lock()
+	defer hsm.Unlock()
+
+	// The state may have been exited while the timer fired.
+	if hsm.runState != ON || !hsm.disarm(state, armed) {
+		return
+	}
+	// Re-arm first; the timer is cancelled if the transition exits the
+	// state.
+	if _, periodic, _ := parseTimeEvent(armed.event); periodic {
+		hsm.armTimer(state, armed.event)
+	}
+
+	handled := false
+	err := hsm.recordTimeEvent(state, armed.event)
+	if err == nil {
+		handled, err = hsm.dispatchTimeEvent(state, armed.event)
+	}
+	if err != nil {
+		hsm.log.WithFields(Fields{
+			"state": state.Name,
+			"on":    armed.event,
+		}).Error("time event failed: ", err)
+	}
+	hsm.dispatchDeferred()
+	hsm.checkpointStep()
+	hsm.dispatchQueued()
+	unhandled := Event("")
+	if err == nil && !handled {
+		unhandled = armed.event
+	}
+	hsm.report(unhandled)
+}
+
+// dispatchTimeEvent takes the transition of the state for its time event,
+// then the completion transitions it enables.  It returns false if no
+// transition is allowed.  The caller must hold the RTC lock.
+func (hsm *Base) dispatchTimeEvent(state *StateInstance, event Event) (
+	bool, error) {
+
+	hsm.notify(Observation{Kind: EventReceived, Event: event,
+		State: state.Name}, time.Time{})
+	segments, err := hsm.selectTransition(state, event, nil)
+	if err != nil || segments == nil {
+		return false, err
+	}
+	err = hsm.applyTransition(segments, nil, state)
+	if err == nil {
+		err = hsm.dispatchCompletions()
+	}
+	return true, err
+}
@@ -0,0 +1,104 @@
+package hsm_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evPoll    hsm.Event = "poll"
+	stDevice  hsm.State = "device"
+	stDialing hsm.State = "dialing"
+	stRetry   hsm.State = "retry"
+	stPolling hsm.State = "polling"
+)
+
+// newTimersHSM builds a device that retries after 5s dialing and that
+// polls every second while polling.
+func newTimersHSM(clock hsm.Clock, polls *int) *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("timersHSM")
+	sm.SetClock(clock)
+
+	device := sm.NewState(stDevice)
+	dialing := sm.NewState(stDialing)
+	dialing.AddTransitions([]hsm.Transition{
+		{On: hsm.After(5 * time.Second), NewState: stRetry},
+		{On: evPoll, NewState: stPolling},
+	})
+	retry := sm.NewState(stRetry)
+	polling := sm.NewState(stPolling)
+	polling.AddTransitions([]hsm.Transition{
+		{On: hsm.Every(time.Second), Action: func(param interface{}) error {
+			*polls++
+			return nil
+		}},
+		{On: hsm.After(3500 * time.Millisecond), NewState: stDialing},
+	})
+
+	device.AddChildren(dialing, retry, polling)
+
+	sm.Finalize()
+	return sm
+}
+
+func TestTimeEvents(t *testing.T) {
+
+	Convey("CASE: Time Events", t, func() {
+		polls := 0
+		clock := hsm.NewFakeClock(time.Unix(0, 0))
+		sm := newTimersHSM(clock, &polls)
+		sm.On()
+
+		Convey("1. After transitions fire once the duration elapses\n", func() {
+			clock.Advance(4 * time.Second)
+			So(sm.CurrentState, ShouldEqual, stDialing)
+			clock.Advance(time.Second)
+			So(sm.CurrentState, ShouldEqual, stRetry)
+		})
+
+		Convey("2. Timers are cancelled when their state is exited\n", func() {
+			clock.Advance(4 * time.Second)
+			So(sm.Inject(evPoll, nil), ShouldBeNil)
+			clock.Advance(2 * time.Second)
+			So(sm.CurrentState, ShouldEqual, stPolling)
+		})
+
+		Convey("3. Every transitions fire while their state is active\n", func() {
+			sm.Inject(evPoll, nil)
+			clock.Advance(3 * time.Second)
+			So(polls, ShouldEqual, 3)
+			clock.Advance(time.Second)
+			So(sm.CurrentState, ShouldEqual, stDialing)
+			clock.Advance(3 * time.Second)
+			So(polls, ShouldEqual, 3)
+		})
+
+		Convey("4. Time events without a positive duration are errors\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("zeroTimersHSM")
+			device := sm.NewState(stDevice)
+			polling := sm.NewState(stPolling)
+			polling.AddTransitions([]hsm.Transition{
+				{On: hsm.Every(0), Action: func(param interface{}) error {
+					polls++
+					return nil
+				}},
+				{On: hsm.After(-time.Second), NewState: stRetry},
+			})
+			device.AddChildren(polling, sm.NewState(stRetry))
+			So(sm.Finalize(), ShouldNotBeNil)
+			So(sm.Validate().Errors(), ShouldResemble, []hsm.Problem{
+				{Severity: hsm.SeverityError, State: stPolling,
+					Event:   hsm.After(-time.Second),
+					Message: "time event needs a valid, positive duration"},
+				{Severity: hsm.SeverityError, State: stPolling,
+					Event:   hsm.Every(0),
+					Message: "time event needs a valid, positive duration"},
+			})
+		})
+	})
+}
@@ -0,0 +1,380 @@
+package hsm
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// FailurePolicy enumeration type that selects how a transition recovers
+// when one of its exit, transition or entry actions returns an error.
+type FailurePolicy int
+
+// FailurePolicy enumeration
+const (
+	// StopOnFailure stops the transition at the failed action, leaving the
+	// current state unchanged.  It is the default policy.
+	StopOnFailure FailurePolicy = iota
+	// CompensateOnFailure stops the transition at the failed action and
+	// runs, in reverse order, the compensating actions registered for the
+	// exit, transition and entry actions that completed, restoring the
+	// active configuration, history and time events held before the
+	// transition.
+	CompensateOnFailure
+	// ContinueOnFailure runs the remaining actions and completes the
+	// transition, collecting every action error.
+	ContinueOnFailure
+	// ErrorStateOnFailure stops the transition at the failed action and
+	// transitions to the error state set with SetErrorState.  Without an
+	// existing error state, the transition stops as for StopOnFailure.
+	ErrorStateOnFailure
+)
+
+// ActionPhase identifies the part of a transition running an action.
+type ActionPhase string
+
+// ActionPhase values
+const (
+	ExitPhase         ActionPhase = "exit"
+	TransitionPhase   ActionPhase = "transition"
+	EntryPhase        ActionPhase = "entry"
+	CompensationPhase ActionPhase = "compensation"
+)
+
+// ActionError describes an action that returned an error.
+type ActionError struct {
+	Phase  ActionPhase
+	State  State
+	Action string
+	Err    error
+}
+
+func (err *ActionError) Error() string {
+	return fmt.Sprintf("%s action %s of %s failed: %v", err.Phase, err.Action,
+		err.State, err.Err)
+}
+
+// Unwrap returns the error returned by the action.
+func (err *ActionError) Unwrap() error {
+	return err.Err
+}
+
+// TransitionError is returned from Inject when actions fail during a
+// transition.  Errors lists every failed action in the order it ran; the
+// first is the failure that stopped the transition, unless the failure
+// policy is ContinueOnFailure.
+type TransitionError struct {
+	Machine string
+	Event   Event
+	Source  State
+	Target  State
+	Errors  []*ActionError
+}
+
+func (err *TransitionError) Error() string {
+	msg := fmt.Sprintf("transition from %s to %s on %s in %s failed: %v",
+		err.Source, err.Target, err.Event, err.Machine, err.Errors[0])
+	if len(err.Errors) > 1 {
+		msg += fmt.Sprintf(" (and %d more errors)", len(err.Errors)-1)
+	}
+	return msg
+}
+
+// Unwrap returns the error returned by the first failed action.
+func (err *TransitionError) Unwrap() error {
+	return err.Errors[0].Err
+}
+
+// SetFailurePolicy selects how transitions recover from failed actions.
+func (hsm *Base) SetFailurePolicy(policy FailurePolicy) {
+	hsm.failurePolicy = policy
+}
+
+// SetErrorState sets the state entered when an action fails under the
+// ErrorStateOnFailure policy.  It must be set before the machine is
+// finalized, for the policy to be validated.
+func (hsm *Base) SetErrorState(name State) {
+	hsm.errorState = name
+}
+
+// AddExitCompensations defines one or more actions undoing the state's exit
+// actions under the CompensateOnFailure policy.  Compensations are paired,
+// in order, with the exit actions, the first undoing the first exit action,
+// and only those of the exit actions that completed run.
+func (state *StateInstance) AddExitCompensations(actions ...ActionFunc) {
+	if state.configurable() {
+		state.exitCompensations = append(state.exitCompensations, actions...)
+	}
+}
+
+// AddEntryCompensations defines one or more actions undoing the state's
+// entry actions under the CompensateOnFailure policy.  Compensations are
+// paired, in order, with the entry actions, as for AddExitCompensations.
+func (state *StateInstance) AddEntryCompensations(actions ...ActionFunc) {
+	if state.configurable() {
+		state.entryCompensations = append(state.entryCompensations, actions...)
+	}
+}
+
+// transaction tracks the progress of a transition so that it can recover
+// from failed actions according to the failure policy.  The active
+// configuration, history, armed timers and pending completions held before
+// the transition are saved to be restored on rollback, as are the
+// snapshots of the sub-machines it turns off.  target is the state the
+// transition enters, once the branches of any choice are selected.
+type transaction struct {
+	policy      FailurePolicy
+	saved       []*StateInstance
+	history     map[State][]State
+	timers      map[*StateInstance][]*armedTimer
+	completions []*StateInstance
+	submachines map[*StateInstance][]byte
+	exited      []*StateInstance
+	entered     []*StateInstance
+	undo        [][]ActionFunc
+	err         *TransitionError
+	target      *StateInstance
+}
+
+func (hsm *Base) newTransaction(policy FailurePolicy,
+	source *StateInstance, tran *Transition) *transaction {
+
+	tx := &transaction{
+		policy: policy,
+		saved:  hsm.leaves,
+		err: &TransitionError{
+			Machine: hsm.Name,
+			Event:   tran.On,
+			Source:  source.Name,
+			Target:  tran.NewState,
+		},
+	}
+	if policy == CompensateOnFailure {
+		tx.history = make(map[State][]State, len(hsm.history))
+		for name, leaves := range hsm.history {
+			tx.history[name] = leaves
+		}
+		tx.timers = make(map[*StateInstance][]*armedTimer, len(hsm.timers))
+		for state, timers := range hsm.timers {
+			tx.timers[state] = timers
+		}
+		tx.completions = hsm.completions
+	}
+	return tx
+}
+
+// runAction runs an action, an ActionFunc or ContextActionFunc, of the
+// transaction, recording its failure.  An error is returned if the
+// transition must stop.
+func (hsm *Base) runAction(tx *transaction, phase ActionPhase,
+	state *StateInstance, tran *Transition, action interface{},
+	param interface{}) error {
+
+	if hsm.suppressActions {
+		return nil
+	}
+	// The remaining actions are aborted once the context is done.
+	if err := hsm.context().Err(); err != nil {
+		tx.err.Errors = append(tx.err.Errors, &ActionError{
+			Phase:  phase,
+			State:  state.Name,
+			Action: funcName(action),
+			Err:    err,
+		})
+		return tx.err
+	}
+
+	start := hsm.now()
+	var err error
+	switch fn := action.(type) {
+	case ActionFunc:
+		err = fn(param)
+	case ContextActionFunc:
+		err = fn(hsm.context(), param)
+	}
+	hsm.logAction(string(phase)+"/", tran, action, param)
+	if phase == TransitionPhase {
+		hsm.notify(Observation{Kind: ActionRun, Event: tx.err.Event,
+			Source: tx.err.Source, Target: tx.err.Target, State: state.Name,
+			Action: funcName(action), Param: param, Err: err}, start)
+	}
+	if err == nil {
+		return nil
+	}
+	tx.err.Errors = append(tx.err.Errors, &ActionError{
+		Phase:  phase,
+		State:  state.Name,
+		Action: funcName(action),
+		Err:    err,
+	})
+	if tx.policy == ContinueOnFailure {
+		return nil
+	}
+	return tx.err
+}
+
+// runStateActions runs the exit or entry actions of a state, then notifies
+// listeners that the state was exited or entered.  The compensation paired
+// with each action that completed is added to the transaction.
+func (hsm *Base) runStateActions(tx *transaction, phase ActionPhase,
+	state *StateInstance, tran *Transition, actions []interface{},
+	compensations []ActionFunc, param interface{}) error {
+
+	start := hsm.now()
+	failed := len(tx.err.Errors)
+	var err error
+	for i, action := range actions {
+		err = hsm.runAction(tx, phase, state, tran, action, param)
+		if err != nil {
+			break
+		}
+		if i < len(compensations) {
+			tx.undo = append(tx.undo, compensations[i:i+1])
+		}
+	}
+	observation := Observation{Kind: StateEntered, Event: tx.err.Event,
+		Source: tx.err.Source, Target: tx.err.Target, State: state.Name,
+		Param: param}
+	if phase == ExitPhase {
+		observation.Kind = StateExited
+	}
+	if len(tx.err.Errors) > failed {
+		observation.Err = tx.err.Errors[failed].Err
+	}
+	hsm.notify(observation, start)
+	return err
+}
+
+// result returns the error collected by the transaction, if any.
+func (tx *transaction) result() error {
+	if len(tx.err.Errors) == 0 {
+		return nil
+	}
+	return tx.err
+}
+
+// recover applies the failure policy once a transition has stopped with the
+// given error.  The error to return from the transition is returned.
+func (hsm *Base) recover(tx *transaction, param interface{}, err error) error {
+	switch tx.policy {
+	case CompensateOnFailure:
+		for i := len(tx.undo) - 1; i >= 0; i-- {
+			for _, action := range tx.undo[i] {
+				compErr := action(param)
+				if compErr != nil {
+					tx.err.Errors = append(tx.err.Errors, &ActionError{
+						Phase:  CompensationPhase,
+						Action: funcName(action),
+						Err:    compErr,
+					})
+				}
+			}
+		}
+		hsm.rollback(tx)
+		hsm.restoreSubmachines(tx)
+	case StopOnFailure:
+		hsm.restoreSubmachines(tx)
+	case ErrorStateOnFailure:
+		errorState, lookupErr := hsm.lookupState(hsm.errorState)
+		if lookupErr != nil {
+			hsm.log.Error(lookupErr)
+			hsm.restoreSubmachines(tx)
+			break
+		}
+		hsm.enterErrorState(tx, errorState, param)
+	}
+	if tx.result() != nil {
+		return tx.err
+	}
+	return err
+}
+
+// enterErrorState settles the active configuration left by a stopped
+// transition, treating the states whose actions ran as exited or entered,
+// then transitions to the error state.  Actions failing on the way to the
+// error state are collected, but do not stop it.
+func (hsm *Base) enterErrorState(tx *transaction, errorState *StateInstance,
+	param interface{}) {
+
+	hsm.commitConfiguration(tx.exited, tx.entered)
+	source, err := hsm.lookupState(hsm.CurrentState)
+	if err != nil {
+		return
+	}
+	// The error state is entered even if the context of the event is done.
+	ctx := hsm.ctx
+	hsm.ctx = nil
+	defer func() { hsm.ctx = ctx }()
+	tran := &Transition{On: tx.err.Event, NewState: errorState.Name}
+	recovery := hsm.newTransaction(ContinueOnFailure, source, tran)
+	domain := hsm.leastCommonAncestor(source, errorState)
+	hsm.runTransition(recovery, []*Transition{tran}, param, domain, source,
+		errorState)
+	tx.err.Errors = append(tx.err.Errors, recovery.err.Errors...)
+}
+
+// restoreConfiguration makes the given leaf states active again, re-arming
+// the time events cancelled since they were last active.
+func (hsm *Base) restoreConfiguration(leaves []*StateInstance) {
+	current := hsm.activeStates()
+	hsm.leaves = leaves
+	restored := hsm.activeStates()
+	for _, state := range current {
+		if !containsState(restored, state) {
+			hsm.cancelTimers(state)
+		}
+	}
+	for _, state := range restored {
+		if len(hsm.timers[state]) == 0 {
+			hsm.armTimers(state)
+		}
+	}
+	hsm.setConfiguration(nil, nil)
+}
+
+// rollback restores the active configuration, history, timers and pending
+// completions saved by the transaction.  Timers armed by the transition are
+// cancelled and timers it cancelled are armed again for the time they had
+// left; timers that fired meanwhile are not.
+func (hsm *Base) rollback(tx *transaction) {
+	for state, timers := range hsm.timers {
+		for _, armed := range timers {
+			if !containsTimer(tx.timers[state], armed) {
+				armed.timer.Stop()
+			}
+		}
+	}
+	current := hsm.timers
+	hsm.timers = make(map[*StateInstance][]*armedTimer)
+	now := hsm.clock.Now()
+	for state, timers := range tx.timers {
+		for _, armed := range timers {
+			if containsTimer(current[state], armed) {
+				hsm.timers[state] = append(hsm.timers[state], armed)
+			} else {
+				hsm.armTimerFor(state, armed.event, armed.due.Sub(now))
+			}
+		}
+	}
+	hsm.history = tx.history
+	hsm.completions = tx.completions
+	hsm.leaves = tx.saved
+	hsm.setConfiguration(nil, nil)
+}
+
+func containsTimer(timers []*armedTimer, armed *armedTimer) bool {
+	for _, t := range timers {
+		if t == armed {
+			return true
+		}
+	}
+	return false
+}
+
+// funcName returns the name of a function, qualified by its package name
+// rather than its full import path.
+func funcName(fn interface{}) string {
+	name := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+	return name[strings.LastIndex(name, "/")+1:]
+}
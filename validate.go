@@ -0,0 +1,432 @@
+package hsm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity of a problem found validating a state machine.
+type Severity int
+
+// Severity enumeration
+const (
+	// SeverityError problems prevent the machine from being finalized.
+	SeverityError Severity = iota
+	// SeverityWarning problems are logged but allowed.
+	SeverityWarning
+)
+
+func (severity Severity) String() string {
+	if severity == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// Problem describes an error or warning found validating a state machine.
+// State and Event, when set, reference the state and event concerned.
+type Problem struct {
+	Severity Severity
+	State    State
+	Event    Event
+	Message  string
+}
+
+func (problem Problem) String() string {
+	refs := []string{}
+	if problem.State != "" {
+		refs = append(refs, "state "+string(problem.State))
+	}
+	if problem.Event != "" {
+		refs = append(refs, "event "+string(problem.Event))
+	}
+	if len(refs) == 0 {
+		return fmt.Sprintf("%s: %s", problem.Severity, problem.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", problem.Severity,
+		strings.Join(refs, ", "), problem.Message)
+}
+
+// ValidationReport lists the problems found validating a state machine.  It
+// is returned as the error of Finalize when it has errors.
+type ValidationReport struct {
+	Machine  string
+	Problems []Problem
+}
+
+// Errors returns the problems with error severity.
+func (report *ValidationReport) Errors() []Problem {
+	return report.filter(SeverityError)
+}
+
+// Warnings returns the problems with warning severity.
+func (report *ValidationReport) Warnings() []Problem {
+	return report.filter(SeverityWarning)
+}
+
+// HasErrors returns true if the report has a problem with error severity.
+func (report *ValidationReport) HasErrors() bool {
+	return len(report.Errors()) > 0
+}
+
+func (report *ValidationReport) Error() string {
+	errors := report.Errors()
+	msgs := make([]string, 0, len(errors))
+	for _, problem := range errors {
+		msgs = append(msgs, problem.String())
+	}
+	return fmt.Sprintf("invalid hsm %s: %s", report.Machine,
+		strings.Join(msgs, "; "))
+}
+
+func (report *ValidationReport) filter(severity Severity) []Problem {
+	problems := []Problem{}
+	for _, problem := range report.Problems {
+		if problem.Severity == severity {
+			problems = append(problems, problem)
+		}
+	}
+	return problems
+}
+
+func (report *ValidationReport) add(severity Severity, state State,
+	event Event, format string, args ...interface{}) {
+	report.Problems = append(report.Problems, Problem{
+		Severity: severity,
+		State:    state,
+		Event:    event,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Validate checks the configured states of the machine and returns a report
+// of every problem found.  Errors are reported for:
+//
+//   - states that are their own ancestor, whose parent chain is a cycle;
+//     the other checks are skipped, as they walk the parent chains
+//   - a missing top state, or more than one state without a parent
+//   - states added more than once with the same name
+//   - states added as children of more than one state
+//   - an unset or missing error state under the ErrorStateOnFailure policy
+//   - transitions whose NewState does not exist
+//   - transitions on time events without a valid, positive duration
+//   - history pseudostates outside a composite state or with children or
+//     transitions
+//   - final states with children or outgoing transitions
+//   - choice and junction pseudostates without branches
+//   - sub-machine states with children
+//   - entry and exit points outside a composite state, without branches
+//     or with children, entry point branches targeting states outside
+//     their composite and exit point branches targeting states inside it
+//
+// Warnings are reported for states unreachable from the top state, for
+// deferred events no state handles and for completion transitions of states
+// that never complete.  Posted events no state handles or defers are
+// reported by Post, as a logged warning.
+func (hsm *Base) Validate() *ValidationReport {
+	report := &ValidationReport{Machine: hsm.Name}
+
+	states := hsm.configuredStates()
+	cyclic := false
+	for _, state := range states {
+		if state.isOwnAncestor() {
+			cyclic = true
+			report.add(SeverityError, state.Name, "",
+				"state is its own ancestor")
+		}
+	}
+	if cyclic {
+		return report
+	}
+
+	topStates := []*StateInstance{}
+	for _, state := range states {
+		if state.parent == nil || state.parent == hsm.topState {
+			topStates = append(topStates, state)
+		}
+	}
+	if len(states) > 0 && len(topStates) == len(states) {
+		report.add(SeverityError, "", "", "no child states were added")
+	} else if len(topStates) > 1 {
+		names := []string{}
+		for _, state := range topStates {
+			names = append(names, string(state.Name))
+		}
+		report.add(SeverityError, "", "",
+			"found more than one top state %s; there needs to be a parent "+
+				"defined for every state except the top state",
+			strings.Join(names, ", "))
+	} else if len(topStates) == 0 {
+		report.add(SeverityError, "", "", "no states were added")
+	}
+
+	for _, name := range hsm.redefined {
+		report.add(SeverityError, name, "",
+			"state was added more than once with the same name")
+	}
+
+	if hsm.failurePolicy == ErrorStateOnFailure {
+		if hsm.errorState == "" {
+			report.add(SeverityError, "", "",
+				"no error state is set for the ErrorStateOnFailure policy")
+		} else if _, ok := hsm.states[hsm.errorState]; !ok {
+			report.add(SeverityError, hsm.errorState, "",
+				"error state does not exist")
+		}
+	}
+
+	handled := map[Event]bool{}
+	for _, state := range states {
+		for _, child := range state.children {
+			if child.parent != state {
+				report.add(SeverityError, child.Name, "",
+					"state was added as a child of %s and %s", state.Name,
+					child.parent.Name)
+			}
+		}
+		for _, event := range sortedEvents(state) {
+			handled[event] = true
+			if _, _, ok := parseTimeEvent(event); !ok &&
+				isTimeEventName(event) {
+				report.add(SeverityError, state.Name, event,
+					"time event needs a valid, positive duration")
+			}
+			for _, tran := range state.transitions[event] {
+				if tran.NewState == "" {
+					continue
+				}
+				if _, ok := hsm.states[tran.NewState]; !ok {
+					report.add(SeverityError, state.Name, event,
+						"transition targets state %s, which does not exist",
+						tran.NewState)
+				}
+			}
+		}
+		hsm.validateKind(report, state)
+	}
+
+	if len(topStates) == 1 {
+		reachable := hsm.reachableStates(topStates[0])
+		for _, state := range states {
+			if !reachable[state] {
+				report.add(SeverityWarning, state.Name, "",
+					"state is unreachable from the top state")
+			}
+		}
+	}
+
+	for _, state := range states {
+		for _, event := range state.deferred {
+			if !handled[event] {
+				report.add(SeverityWarning, state.Name, event,
+					"deferred event is never handled")
+			}
+		}
+		if state.kind == regularState && len(state.transitions[""]) > 0 &&
+			!state.completes() {
+			report.add(SeverityWarning, state.Name, "",
+				"completion event is never raised")
+		}
+	}
+	return report
+}
+
+// isOwnAncestor returns true if the parent chain of the state leads back to
+// the state.
+func (state *StateInstance) isOwnAncestor() bool {
+	seen := map[*StateInstance]bool{}
+	for parent := state.parent; parent != nil; parent = parent.parent {
+		if parent == state {
+			return true
+		}
+		if seen[parent] {
+			return false
+		}
+		seen[parent] = true
+	}
+	return false
+}
+
+// completes returns true if the state can complete: it has a final state
+// child, all its regions can complete or it is a sub-machine state.
+func (state *StateInstance) completes() bool {
+	if state.submachine != nil {
+		return true
+	}
+	if state.parallel {
+		for _, region := range state.children {
+			if region.kind == regularState && !region.completes() {
+				return false
+			}
+		}
+		return true
+	}
+	for _, child := range state.children {
+		if child.kind == finalState {
+			return true
+		}
+	}
+	return false
+}
+
+// definesEvent returns true if a state has a transition for the event or
+// defers it.
+func (hsm *Base) definesEvent(event Event) bool {
+	for _, state := range hsm.states {
+		if len(state.transitions[event]) > 0 {
+			return true
+		}
+		for _, deferred := range state.deferred {
+			if deferred == event {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateKind checks the children and transitions of pseudostates, final
+// states and sub-machine states.
+func (hsm *Base) validateKind(report *ValidationReport, state *StateInstance) {
+	switch state.kind {
+	case shallowHistoryState, deepHistoryState:
+		if state.parent == nil || state.parent == hsm.topState {
+			report.add(SeverityError, state.Name, "",
+				"history pseudostate must be a child of a composite state")
+		}
+		if len(state.children) > 0 {
+			report.add(SeverityError, state.Name, "",
+				"history pseudostate cannot have children")
+		}
+		if len(state.transitions) > 0 {
+			report.add(SeverityError, state.Name, "",
+				"history pseudostate cannot have transitions")
+		}
+	case finalState:
+		if len(state.children) > 0 {
+			report.add(SeverityError, state.Name, "",
+				"final state cannot have children")
+		}
+		if len(state.transitions) > 0 {
+			report.add(SeverityError, state.Name, "",
+				"final state cannot have outgoing transitions")
+		}
+	case entryPointState, exitPointState:
+		hsm.validateConnection(report, state)
+	case regularState:
+		if state.submachine != nil && len(state.children) > 0 {
+			report.add(SeverityError, state.Name, "",
+				"sub-machine state cannot have children")
+		}
+	case choiceState, junctionState:
+		if len(state.transitions[""]) == 0 {
+			report.add(SeverityError, state.Name, "",
+				"choice or junction pseudostate has no branches")
+		}
+		if len(state.children) > 0 {
+			report.add(SeverityError, state.Name, "",
+				"choice or junction pseudostate cannot have children")
+		}
+	}
+}
+
+// validateConnection checks the parent, children and branches of entry and
+// exit points.
+func (hsm *Base) validateConnection(report *ValidationReport,
+	state *StateInstance) {
+
+	composite := state.parent
+	if composite == nil || composite == hsm.topState {
+		report.add(SeverityError, state.Name, "",
+			"entry or exit point must be a child of a composite state")
+		return
+	}
+	if len(state.children) > 0 {
+		report.add(SeverityError, state.Name, "",
+			"entry or exit point cannot have children")
+	}
+	if len(state.transitions[""]) == 0 {
+		report.add(SeverityError, state.Name, "",
+			"entry or exit point has no branches")
+	}
+	for _, tran := range state.transitions[""] {
+		target, ok := hsm.states[tran.NewState]
+		if !ok {
+			continue
+		}
+		inside := composite.contains(target) && target != composite
+		if state.kind == entryPointState && !inside {
+			report.add(SeverityError, state.Name, "",
+				"entry point branch targets %s, outside composite %s",
+				target.Name, composite.Name)
+		} else if state.kind == exitPointState && inside {
+			report.add(SeverityError, state.Name, "",
+				"exit point branch targets %s, inside composite %s",
+				target.Name, composite.Name)
+		}
+	}
+}
+
+// configuredStates returns the states added with NewState, sorted by name,
+// leaving out the top state added by Finalize.
+func (hsm *Base) configuredStates() []*StateInstance {
+	states := []*StateInstance{}
+	for _, state := range hsm.states {
+		if state != hsm.topState {
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return states
+}
+
+// reachableStates returns the states that can become active starting from
+// the top state, entering default states and regions and taking the
+// transitions of active states and their ancestors.
+func (hsm *Base) reachableStates(top *StateInstance) map[*StateInstance]bool {
+	reachable := map[*StateInstance]bool{}
+	pending := []*StateInstance{top}
+	reach := func(state *StateInstance) {
+		if state != nil && !reachable[state] {
+			reachable[state] = true
+			pending = append(pending, state)
+		}
+	}
+	reachable[top] = true
+	for len(pending) > 0 {
+		state := pending[0]
+		pending = pending[1:]
+		reach(state.parent)
+		if state.parallel {
+			for _, child := range state.children {
+				if child.kind == regularState {
+					reach(child)
+				}
+			}
+		} else if state.initialState != "" {
+			reach(hsm.states[state.initialState])
+		}
+		for _, trans := range state.transitions {
+			for _, tran := range trans {
+				reach(hsm.states[tran.NewState])
+			}
+		}
+	}
+	delete(reachable, hsm.topState)
+	return reachable
+}
+
+// sortedEvents returns the events of the state's transitions in name order.
+func sortedEvents(state *StateInstance) []Event {
+	events := make([]Event, 0, len(state.transitions))
+	for event := range state.transitions {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i] < events[j]
+	})
+	return events
+}
@@ -0,0 +1,131 @@
+package hsm_test
+
+import (
+	"testing"
+
+	"github.com/ckbaldy/hsm"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	evOpen    hsm.Event = "open"
+	evClose   hsm.Event = "close"
+	evLock    hsm.Event = "lock"
+	stDoor    hsm.State = "door"
+	stClosed  hsm.State = "closed"
+	stOpened  hsm.State = "opened"
+	stLocked  hsm.State = "locked"
+	stMissing hsm.State = "missing"
+	stDoorEnd hsm.State = "doorEnd"
+)
+
+// newValidateHSM configures a door whose closed state has a transition to a
+// missing state, an unreachable locked state and a final state with an
+// outgoing transition.
+func newValidateHSM() *hsm.Base {
+	sm := &hsm.Base{}
+	sm.Configure("validateHSM")
+
+	door := sm.NewState(stDoor)
+	closed := sm.NewState(stClosed)
+	closed.AddDeferredEvents(evLock)
+	closed.AddTransitions([]hsm.Transition{
+		{On: evOpen, NewState: stOpened},
+		{On: evClose, NewState: stMissing},
+	})
+	opened := sm.NewState(stOpened)
+	opened.AddTransitions([]hsm.Transition{
+		{On: evClose, NewState: stDoorEnd}})
+	locked := sm.NewState(stLocked)
+	end := sm.NewFinalState(stDoorEnd)
+	end.AddTransitions([]hsm.Transition{
+		{On: evOpen, NewState: stOpened}})
+
+	door.AddChildren(closed, opened, locked, end)
+	return sm
+}
+
+func TestValidation(t *testing.T) {
+
+	Convey("CASE: Finalize Validation", t, func() {
+		sm := newValidateHSM()
+
+		Convey("1. Validate reports errors and warnings with references\n", func() {
+			report := sm.Validate()
+			So(report.Errors(), ShouldResemble, []hsm.Problem{
+				{Severity: hsm.SeverityError, State: stClosed, Event: evClose,
+					Message: "transition targets state missing, which does not exist"},
+				{Severity: hsm.SeverityError, State: stDoorEnd,
+					Message: "final state cannot have outgoing transitions"},
+			})
+			So(report.Warnings(), ShouldResemble, []hsm.Problem{
+				{Severity: hsm.SeverityWarning, State: stLocked,
+					Message: "state is unreachable from the top state"},
+				{Severity: hsm.SeverityWarning, State: stClosed, Event: evLock,
+					Message: "deferred event is never handled"},
+			})
+		})
+
+		Convey("2. Finalize returns the report when it has errors\n", func() {
+			err := sm.Finalize()
+			So(err, ShouldNotBeNil)
+			report, ok := err.(*hsm.ValidationReport)
+			So(ok, ShouldBeTrue)
+			So(report.Errors(), ShouldHaveLength, 2)
+			So(sm.On(), ShouldNotBeNil)
+		})
+
+		Convey("3. States added twice with the same name are errors\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("duplicateHSM")
+			door := sm.NewState(stDoor)
+			door.AddChildren(sm.NewState(stClosed), sm.NewState(stClosed))
+			So(sm.Finalize(), ShouldNotBeNil)
+			So(sm.Validate().Errors()[0].State, ShouldEqual, stClosed)
+			sm.Configure("duplicateHSM")
+			So(sm.Finalize(), ShouldBeNil)
+		})
+
+		Convey("4. A machine needs child states\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("singleHSM")
+			sm.NewState(stDoor)
+			So(sm.Finalize(), ShouldNotBeNil)
+		})
+
+		Convey("5. Completion transitions of states that never complete are warned\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("completionHSM")
+			door := sm.NewState(stDoor)
+			closed := sm.NewState(stClosed)
+			closed.AddTransitions([]hsm.Transition{{NewState: stOpened}})
+			door.AddChildren(closed, sm.NewState(stOpened))
+			So(sm.Validate().Warnings(), ShouldResemble, []hsm.Problem{
+				{Severity: hsm.SeverityWarning, State: stClosed,
+					Message: "completion event is never raised"},
+			})
+		})
+
+		Convey("6. States whose parent chain is a cycle are errors\n", func() {
+			sm := &hsm.Base{}
+			sm.Configure("cyclicHSM")
+			door := sm.NewState(stDoor)
+			closed := sm.NewState(stClosed)
+			closed.AddTransitions([]hsm.Transition{
+				{On: evOpen, NewState: stOpened}})
+			opened := sm.NewState(stOpened)
+			locked := sm.NewState(stLocked)
+			door.AddChildren(closed)
+			opened.AddChildren(locked)
+			locked.AddChildren(opened)
+			So(sm.Finalize(), ShouldNotBeNil)
+			So(sm.Validate().Errors(), ShouldResemble, []hsm.Problem{
+				{Severity: hsm.SeverityError, State: stLocked,
+					Message: "state is its own ancestor"},
+				{Severity: hsm.SeverityError, State: stOpened,
+					Message: "state is its own ancestor"},
+			})
+			So(sm.On(), ShouldNotBeNil)
+		})
+	})
+}